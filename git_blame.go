@@ -0,0 +1,225 @@
+package gitserver
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// Maximum number of blame results kept in the cache
+const blameCacheSize = 128
+
+// blameCache holds computed blame results, it is cleared once it grows past blameCacheSize
+type blameCache struct {
+	mu      sync.Mutex
+	entries map[string][]GitBlameLine
+}
+
+func (bc *blameCache) get(key string) ([]GitBlameLine, bool) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	lines, ok := bc.entries[key]
+	return lines, ok
+}
+
+func (bc *blameCache) put(key string, lines []GitBlameLine) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if bc.entries == nil || len(bc.entries) >= blameCacheSize {
+		bc.entries = make(map[string][]GitBlameLine)
+	}
+	bc.entries[key] = lines
+}
+
+func (bc *blameCache) clear() {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.entries = nil
+}
+
+type GitBlameLine struct {
+	// Line number in the file, starting at 1
+	LineNo int
+	// Line contents
+	Content string
+	// SHA1 hash of the commit that last touched the line
+	CommitHash string
+	// Email of the author of that commit
+	Author string
+	// Date the line was introduced
+	Date string
+}
+
+// serveBlame populates the blame page for a '<ref>/<path>' argument string
+func (gsrv *GitServer) serveBlame(repo *git.Repository, pageArgs string, gb *GitBrowser) error {
+	refStr, filePath, err := splitRefPath(pageArgs)
+	if err != nil {
+		return err
+	}
+
+	hash, err := gsrv.resolveRevision(repo, refStr)
+	if err != nil {
+		return caddyhttp.Error(revisionStatus(err), err)
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+	file, err := commit.File(filePath)
+	if err != nil {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+
+	// Blame walks the history of the file, so reuse previous results when we can.
+	// The same blob can have a different history on another commit, so both are part of the key.
+	cacheKey := commit.Hash.String() + ":" + file.Hash.String()
+	lines, ok := gsrv.blameCache.get(cacheKey)
+
+	if !ok {
+		result, err := blameFile(commit, filePath)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		for i, l := range result {
+			lines = append(lines, GitBlameLine{
+				LineNo:     i + 1,
+				Content:    l.text,
+				CommitHash: l.commit.Hash.String(),
+				Author:     l.commit.Author.Email,
+				Date:       gsrv.formatDate(l.commit.Author.When),
+			})
+		}
+		gsrv.blameCache.put(cacheKey, lines)
+	}
+
+	gb.FilePath = filePath
+	gb.FileRef = refStr
+	gb.Blame = lines
+	return nil
+}
+
+// Maximum number of commits blame walks back through the history of a file. Lines that are still
+// older than that are attributed to the last commit reached, like 'git blame' at a boundary.
+const blameMaxCommits = 10000
+
+// blameLine is a line of a blamed file and the commit that last changed it
+type blameLine struct {
+	text   string
+	commit *object.Commit
+}
+
+// blameFile finds the commit that last changed each line of the file at path in commit.
+// It follows the history of the file back from commit, diffing each version against the one before it:
+// lines that are the same in the parent are passed on to the parent, the others were changed by the commit.
+// When a parent of a merge has the same version of the file, all of its lines are passed on to that parent.
+func blameFile(commit *object.Commit, path string) ([]blameLine, error) {
+	file, err := commit.File(path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+
+	texts := splitLines(content)
+	result := make([]blameLine, len(texts))
+	// Lines that aren't attributed yet, by their line number in the current version and then in the result
+	pending := make(map[int]int, len(texts))
+	for i, text := range texts {
+		result[i].text = text
+		pending[i] = i
+	}
+
+	cur, curFile, curContent := commit, file, content
+	for walked := 0; len(pending) > 0; walked++ {
+		parent, parentFile, err := blameParent(cur, path, curFile)
+		if err != nil {
+			return nil, err
+		}
+		if parent == nil || walked >= blameMaxCommits {
+			for _, r := range pending {
+				result[r].commit = cur
+			}
+			break
+		}
+
+		if parentFile.Hash != curFile.Hash {
+			parentContent, err := parentFile.Contents()
+			if err != nil {
+				return nil, err
+			}
+			next := make(map[int]int, len(pending))
+			curLine, parentLine := 0, 0
+			for _, d := range diff.Do(parentContent, curContent) {
+				n := len(splitLines(d.Text))
+				switch d.Type {
+				case diffmatchpatch.DiffEqual:
+					for i := 0; i < n; i++ {
+						if r, ok := pending[curLine+i]; ok {
+							next[parentLine+i] = r
+						}
+					}
+					curLine += n
+					parentLine += n
+				case diffmatchpatch.DiffInsert:
+					for i := 0; i < n; i++ {
+						if r, ok := pending[curLine+i]; ok {
+							result[r].commit = cur
+						}
+					}
+					curLine += n
+				case diffmatchpatch.DiffDelete:
+					parentLine += n
+				}
+			}
+			pending = next
+			curContent = parentContent
+		}
+		cur, curFile = parent, parentFile
+	}
+	return result, nil
+}
+
+// blameParent returns the parent of c that blame continues with, and its version of the file at path.
+// A parent with the same version as file is preferred, otherwise the first parent that has the file.
+// The parent is nil when no parent has the file, c added it.
+func blameParent(c *object.Commit, path string, file *object.File) (*object.Commit, *object.File, error) {
+	var first *object.Commit
+	var firstFile *object.File
+	parents := c.Parents()
+	defer parents.Close()
+	err := parents.ForEach(func(parent *object.Commit) error {
+		parentFile, err := parent.File(path)
+		if errors.Is(err, object.ErrFileNotFound) || errors.Is(err, object.ErrDirectoryNotFound) || errors.Is(err, object.ErrEntryNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if parentFile.Hash == file.Hash {
+			first, firstFile = parent, parentFile
+			return storer.ErrStop
+		}
+		if first == nil {
+			first, firstFile = parent, parentFile
+		}
+		return nil
+	})
+	return first, firstFile, err
+}
+
+// splitLines splits text into lines, a trailing newline doesn't start another line
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
@@ -0,0 +1,54 @@
+package gitserver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestBlameLineInsertedInTheMiddle(t *testing.T) {
+	dir, run := testRepo(t)
+	commit := func(content string, message string) string {
+		if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		run("add", "a.txt")
+		run("commit", "-q", "-m", message)
+		return run("rev-parse", "HEAD")
+	}
+	first := commit("one\ntwo\nthree\nfour\n", "first")
+	second := commit("one\ntwo\ninserted\nthree\nfour\n", "second")
+	third := commit("one\ntwo\ninserted\nthree\nfour changed\n", "third")
+
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.CommitObject(plumbing.NewHash(third))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, err := blameFile(head, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct{ text, commit string }{
+		{"one", first},
+		{"two", first},
+		{"inserted", second},
+		{"three", first},
+		{"four changed", third},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("blamed %d lines, want %d", len(lines), len(want))
+	}
+	for i, w := range want {
+		if lines[i].text != w.text || lines[i].commit.Hash.String() != w.commit {
+			t.Errorf("line %d = %q from %s, want %q from %s", i+1, lines[i].text, lines[i].commit.Hash, w.text, w.commit)
+		}
+	}
+}
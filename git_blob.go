@@ -0,0 +1,148 @@
+package gitserver
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/go-git/go-git/v5"
+)
+
+// serveBlob populates the blob page for a '<ref>/<path>' argument string.
+// Files larger than max_blob_size and binary files are not read, the page links to the raw file instead.
+// Images are shown from the raw file.
+func (gsrv *GitServer) serveBlob(repo *git.Repository, pageArgs string, gb *GitBrowser) error {
+	refStr, filePath, err := splitRefPath(pageArgs)
+	if err != nil {
+		return err
+	}
+
+	hash, err := gsrv.resolveRevision(repo, refStr)
+	if err != nil {
+		return caddyhttp.Error(revisionStatus(err), err)
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+	file, err := commit.File(filePath)
+	if err != nil {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+
+	gb.FilePath = filePath
+	gb.FileRef = refStr
+	gb.BlobSize = file.Size
+
+	reader, err := file.Reader()
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	defer reader.Close()
+
+	// Only the start of the file is read to decide how to show it
+	content := bufio.NewReaderSize(reader, binaryCheckSize)
+	head, _ := content.Peek(binaryCheckSize)
+	switch {
+	case imageContentType(filePath, head) != "":
+		gb.BlobKind = "image"
+	case isBinary(head):
+		gb.BlobKind = "binary"
+	default:
+		gb.BlobKind = "text"
+	}
+
+	// Images are embedded from the raw endpoint, the page doesn't need their contents
+	if gb.BlobKind == "image" {
+		return nil
+	}
+
+	// The size is known from the object header, so large files are never read
+	if file.Size > gsrv.MaxBlobSize {
+		gb.BlobTooLarge = true
+		return nil
+	}
+	if gb.BlobKind == "binary" {
+		return nil
+	}
+
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	// LFS pointers only describe the real file, which is stored on the LFS server
+	if oid, size, ok := parseLFSPointer(data); ok {
+		gb.BlobLFSOid = oid
+		gb.BlobLFSSize = size
+		return nil
+	}
+
+	gb.BlobContent = string(data)
+	return nil
+}
+
+// Image types shown on the blob page, keyed by file extension
+var imageContentTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".svg":  "image/svg+xml",
+}
+
+// imageContentType returns the content type of an image file, or an empty string if it isn't an image.
+// The extension has to match the start of the contents, so a renamed file isn't served as an image.
+func imageContentType(filePath string, head []byte) string {
+	contentType, ok := imageContentTypes[strings.ToLower(path.Ext(filePath))]
+	if !ok {
+		return ""
+	}
+	if contentType == "image/svg+xml" {
+		if bytes.Contains(head, []byte("<svg")) {
+			return contentType
+		}
+		return ""
+	}
+	if http.DetectContentType(head) != contentType {
+		return ""
+	}
+	return contentType
+}
+
+// Git LFS pointer files are never larger than this
+const lfsPointerMaxSize = 1024
+
+// parseLFSPointer returns the oid and size of the object a Git LFS pointer file refers to.
+// See https://github.com/git-lfs/git-lfs/blob/main/docs/spec.md
+func parseLFSPointer(data []byte) (string, int64, bool) {
+	if len(data) > lfsPointerMaxSize || !bytes.HasPrefix(data, []byte("version https://git-lfs.github.com/spec/")) {
+		return "", 0, false
+	}
+
+	var oid string
+	var size int64 = -1
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "oid":
+			oid = value
+		case "size":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return "", 0, false
+			}
+			size = n
+		}
+	}
+	if oid == "" || size < 0 {
+		return "", 0, false
+	}
+	return oid, size, true
+}
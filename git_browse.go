@@ -1,20 +1,31 @@
 package gitserver
 
 import (
+	"crypto/sha1"
 	_ "embed"
-	"html/template"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/caddyserver/caddy/v2"
+	"github.com/Masterminds/semver/v3"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
 	"go.uber.org/zap"
 )
 
@@ -39,16 +50,44 @@ var template_page_tree string
 //go:embed templates/log.html
 var template_page_log string
 
+//go:embed templates/commit.html
+var template_page_commit string
+
+//go:embed templates/blame.html
+var template_page_blame string
+
+//go:embed templates/index.html
+var template_page_index string
+
+//go:embed templates/error.html
+var template_page_error string
+
+//go:embed templates/maintenance.html
+var template_page_maintenance string
+
+//go:embed templates/search.html
+var template_page_search string
+
+//go:embed templates/compare.html
+var template_page_compare string
+
 // Static assets
 //
 //go:embed static/git-icon.b64
 var static_gitIcon string
 
 var template_pages = map[string]*string{
-	"home": &template_page_home,
-	"blob": &template_page_blob,
-	"tree": &template_page_tree,
-	"log":  &template_page_log,
+	"home":        &template_page_home,
+	"blob":        &template_page_blob,
+	"tree":        &template_page_tree,
+	"log":         &template_page_log,
+	"commit":      &template_page_commit,
+	"blame":       &template_page_blame,
+	"index":       &template_page_index,
+	"search":      &template_page_search,
+	"compare":     &template_page_compare,
+	"maintenance": &template_page_maintenance,
+	"error":       &template_page_error,
 }
 
 var static_assets = StaticAssets{
@@ -64,20 +103,122 @@ type GitBrowser struct {
 	CloneURL    string
 	Now         string
 	Scheme      string
-	Page        string
-	Root        string
+
+	// Go time layout dates are shown in, e.g. '{{ .Commit.CommittedDate.Format $.DateFormat }}'
+	DateFormat string
+
+	Page string
+	Root string
+	// URL path every page is served below, the IgnorePrefix without slashes. Empty without one.
+	Prefix string
 
 	Branches []GitRef
 	Tags     []GitRef
+	// Number of branches and tags, shown on the home page
+	BranchCount int
+	TagCount    int
+	// How far the displayed ref is ahead of and behind the default branch, nil when it is the default branch
+	AheadBehind *GitAheadBehind
+	// Repository has no refs yet, e.g. a freshly initialized bare repository
+	Empty bool
+
+	// Ref the page is displaying and its type: 'branch', 'tag', or 'commit'.
+	// Set from the 'ref' query parameter, or the HEAD branch by default.
+	CurrentRef     string
+	CurrentRefType string
 
 	Commits []GitCommit
+	// Path the log is filtered by, only commits that touched it are listed
+	LogPath string
+	// Author the log is filtered by, only commits whose author name or email contains it are listed
+	LogAuthor string
+	// The filtered log stopped looking for matching commits after LogLimit, or logFilterMaxCommits, commits
+	LogTruncated bool
+
+	// Log and search pagination, a page number of 0 means there is no such page.
+	// The last page is only known for searches that weren't truncated.
+	PageNumber int
+	PrevPage   int
+	NextPage   int
+	LastPage   int
 
 	Files []GitFile
+	// Every entry of the tree with nested directories, only loaded with '?recursive=1'.
+	// Truncated when the tree has more than fileTreeMaxEntries entries.
+	FileTree          []GitTreeEntry
+	FileTreeTruncated bool
+
+	// File search query, whether file contents are searched, results for the current page, and total number of results
+	SearchQuery   string
+	SearchContent bool
+	SearchResults []GitSearchResult
+	SearchTotal   int
+	// The search stopped after searchMaxResults results, or after reading searchMaxBlobs files or searchMaxBytes
+	// bytes of file contents. SearchTotal is a lower bound.
+	SearchTruncated bool
+
+	// Repositories listed on the index page
+	Repositories []GitRepo
+	// Directory the repository is in, or the directory listed on the index page. Empty at the root.
+	Namespace string
+
+	// Commit shown on the commit page and the changes it introduced
+	Commit GitCommit
+	Diff   []GitDiffFile
+
+	// Revisions compared on the compare page and the commit they diverged at.
+	// Commits holds the commits on the head that aren't on the base, Diff the changes since the merge base.
+	CompareBase      string
+	CompareHead      string
+	CompareMergeBase string
+	// More than compareMaxCommits commits differ, only the first are listed
+	CompareTruncated bool
+	// More than compareMaxFiles files changed, only the first are diffed
+	CompareDiffTruncated bool
+
+	// File shown on the blame page, the ref it was read from and the commit that last touched each line
+	FilePath string
+	FileRef  string
+	Blame    []GitBlameLine
+
+	// Contents of the file shown on the blob page, empty when it is binary or too large
+	BlobContent string
+	BlobSize    int64
+	// How the file is shown: 'text', 'image', or 'binary'
+	BlobKind     string
+	BlobTooLarge bool
+	// Object a Git LFS pointer file refers to, set instead of BlobContent
+	BlobLFSOid  string
+	BlobLFSSize int64
+
+	// Size in bytes of the objects directory and the number of objects in it, shown on the home page
+	RepoSize    int64
+	ObjectCount int64
+
+	// Notice shown on the maintenance page
+	MaintenanceMessage string
+
+	// Status code of the error page and its standard text, e.g. 'Not Found'
+	ErrorStatus int
+	ErrorText   string
+	// Explanation of a client error that is safe to show, e.g. why a revision didn't resolve
+	ErrorMessage string
 
 	// Static assets
 	Assets StaticAssets
 }
 
+type GitRepo struct {
+	// Path of the repository relative to the root, without the .git suffix
+	Name string
+	// URL path of the repository browser
+	URL         string
+	Tagline     string
+	Description string
+	// Date of the latest commit on HEAD, empty if the repo has no commits
+	Updated string
+}
+
 type GitRef struct {
 	// SHA1 hash
 	Hash string
@@ -85,29 +226,60 @@ type GitRef struct {
 	Type string
 	// Name of branch or tag
 	Name string
+	// SHA1 hash of the commit the ref points to. Annotated tags point at a
+	// tag object, so for them this differs from Hash.
+	Commit    string
+	Annotated bool
 }
 
 type GitCommit struct {
 	// SHA1 commit hash
 	Hash string
-	//Author of commit
-	Author string
-	// Committer of commit
+	// Author of commit, and when it was authored
+	AuthorName   string
+	AuthorEmail  string
+	AuthoredDate time.Time
+	// Committer of commit, and when it was committed
+	CommitterName  string
+	CommitterEmail string
+	CommittedDate  time.Time
+	// Author and committer formatted as 'Name <email>'
+	Author    string
 	Committer string
-	// Commit message
+	// Commit message, and the message split into its first line and the rest
 	Message string
+	Subject string
+	Body    string
 	// Creation date (done by Author)
 	Date string
+	// Signature was verified against the configured signers, and the identity that signed it
+	Verified bool
+	SignedBy string
+	// SHA1 hashes of the parent commits, the first parent first. Empty for a root commit.
+	Parents []string
 }
 
 type GitFile struct {
-	Name   string
-	Mode   string
-	Commit GitCommit
+	Name string
+	Mode string
+	// Size of the file in bytes, 0 for directories and submodules
+	Size int64
+	// Last commit that changed the entry and its date, empty if it wasn't found within treeHistoryLimit commits
+	Commit  GitCommit
+	Updated string
+	// Path the entry points to if it is a symlink
+	SymlinkTarget string
+	// Remote url of the entry if it is a submodule, as written in .gitmodules
+	SubmoduleURL string
+	// Web address of the submodule's repository, empty if its url isn't reachable over http(s)
+	SubmoduleLink string
 }
 
 type StaticAssets struct {
+	// Base64 encoded git icon for inlining
 	GitIcon string
+	// URL path the static assets are served from, e.g. '{{.Assets.Path}}/git-icon.ico'
+	Path string
 }
 
 func (gsrv *GitServer) serveGitBrowser(repoPath string, w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
@@ -118,175 +290,275 @@ func (gsrv *GitServer) serveGitBrowser(repoPath string, w http.ResponseWriter, r
 		return caddyhttp.Error(http.StatusInternalServerError, err)
 	}
 
-	// Setup function map
-	fm := template.FuncMap{
-		"split": strings.Split,
-	}
+	// Decide which page to load and read template file if necessary
+	repoName, pageName, pageArgs := gsrv.parseBrowserPath(repoPath, r)
+	pfx := repoName
 
-	// Decide which base template to use (default embedded or user defined)
-	// User template must be named "base.html" and be in the template_dir
-	templateBaseStr := &template_base
-	templateBaseName := "default"
-	if gsrv.TemplateDir != "" {
-		tbn := filepath.Join(gsrv.TemplateDir, "base.html")
-		userBase, err := os.ReadFile(tbn)
-		if err == nil {
-			// Convert the read file into a string and set the new filename
-			user_template_base := string(userBase)
-			templateBaseStr = &user_template_base
-			templateBaseName = tbn
-		}
+	// 'go get' only needs the meta tags, which are the same for every page and package in the repository
+	if isGoGet(r) {
+		return gsrv.serveGoGet(repoName, w, r)
+	}
+	// The index and maintenance pages only exist outside of a repository
+	templatePage := pageName
+	if templatePage == "index" || templatePage == "maintenance" || templatePage == "error" {
+		templatePage = "404"
 	}
-	// Load up our base template
-	browseTemplate, err := template.New("browse").Funcs(fm).Parse(*templateBaseStr)
+	browseTemplate, templateBaseName, templatePageName, err := gsrv.loadBrowseTemplate(repoName, templatePage)
 	if err != nil {
 		return caddyhttp.Error(http.StatusInternalServerError, err)
 	}
 
-	// Decide which page to load and read template file if necessary
-	// Page is determined by the path segment following the repository.
-	// Any path after that is path arguments, currently only the reference
-	root := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer).ReplaceAll(gsrv.Root, ".")
-	pfx := strings.TrimPrefix(strings.TrimSuffix(strings.TrimPrefix(repoPath, root), ".git"), "/")
-	pageName, _, defined := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"), pfx), "/"), "/")
-	if !defined && pageName == "" {
-		pageName = "home"
-	}
-	// fmt.Println("looking for page", pageName)
-	templatePageStr := template_pages[pageName]
-	templatePageName := "default-" + pageName
-	if gsrv.TemplateDir != "" {
-		tpn := filepath.Join(gsrv.TemplateDir, pageName+".html")
-		userPage, err := os.ReadFile(tpn)
-		if err == nil {
-			user_template_page := string(userPage)
-			templatePageStr = &user_template_page
-			templatePageName = tpn
-		}
-	}
-
-	// If we couldn't find a page template, use the 404 page
-	if templatePageStr == nil {
-		templatePageStr = &template_page_404
-		templatePageName = "default-404"
-		if gsrv.TemplateDir != "" {
-			tpn := filepath.Join(gsrv.TemplateDir, "404.html")
-			user404, err := os.ReadFile(tpn)
-			if err == nil {
-				// Use user 404 page if one is found
-				user_template_page := string(user404)
-				templatePageStr = &user_template_page
-				templatePageName = tpn
-			}
-		}
+	// Links and the clone url are relative to the host, so they keep the ignored prefix
+	if gsrv.IgnorePrefix != "" {
+		pfx = strings.Trim(gsrv.IgnorePrefix, "/") + "/" + pfx
 	}
 
-	// Load up our page template
-	browseTemplate.Parse(*templatePageStr)
-
 	// Create our template data object
 	gb := GitBrowser{
-		Name:   strings.TrimSuffix(filepath.Base(repoPath), ".git"),
-		Path:   r.URL.Path,
-		Page:   pageName,
-		Host:   r.Host,
-		Now:    time.Now().UTC().Format(time.UnixDate),
-		Assets: static_assets,
-		Root:   pfx,
+		Name:       strings.TrimSuffix(filepath.Base(repoPath), gsrv.RepoSuffix),
+		Path:       r.URL.Path,
+		Page:       pageName,
+		Host:       r.Host,
+		Now:        gsrv.formatDate(time.Now().UTC()),
+		DateFormat: gsrv.DateFormat,
+		Assets:     gsrv.staticAssets(),
+		Root:       pfx,
+		Prefix:     strings.Trim(gsrv.IgnorePrefix, "/"),
+	}
+	if namespace := path.Dir(repoName); namespace != "." {
+		gb.Namespace = namespace
 	}
 
-	// Open the description file
-	file, err := os.Open(filepath.Join(repoPath, "description"))
+	// Read the tagline and description
+	gb.Tagline, gb.Description, err = gsrv.repoDescription(repoName, repoPath)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	// Read the full description file (keep it short)
-	descBytes, err := io.ReadAll(file)
-	if err != nil {
-		// No description file?
-		return caddyhttp.Error(http.StatusInternalServerError, err)
+	// Construct the clone url
+	cloneUrl := gsrv.publicBaseURL(r) + "/" + pfx + gsrv.RepoSuffix
+	gb.CloneURL = cloneUrl
+
+	// The feed is not an html page, so it doesn't need the rest of the template data
+	if pageName == "feed.atom" {
+		return gsrv.serveFeed(repo, repoName, &gb, w, r)
 	}
 
-	// Get first line as tagline, rest of file is the long description
-	gb.Tagline, gb.Description, _ = strings.Cut(string(descBytes), "\n")
+	// Raw files are served as they are stored in the repository
+	if pageName == "raw" {
+		return gsrv.serveRaw(repo, pageArgs, w, r)
+	}
 
-	// Set the scheme if it is empty. This is for generating a proper clone url
-	if r.URL.Scheme == "" {
-		if r.TLS == nil {
-			r.URL.Scheme = "http"
-		} else {
-			r.URL.Scheme = "https"
-		}
+	// Tooling polls the refs, which don't need any of the template data
+	if pageName == "refs.json" {
+		return gsrv.serveRefs(repo, w, r)
 	}
 
-	// Construct the clone url
-	cloneUrl := r.URL.Scheme + "://" + r.Host + "/" + pfx + ".git"
-	gb.CloneURL = cloneUrl
+	// A commit can be fetched as a patch file to apply with 'git am'
+	if pageName == "commit" && strings.HasSuffix(pageArgs, ".patch") {
+		return gsrv.servePatch(repo, strings.TrimSuffix(pageArgs, ".patch"), w, r)
+	}
 
-	// Extract branches from repo
-	branches, err := repo.Branches()
+	// Extract branches and tags from repo
+	gb.Branches, gb.Tags, err = gsrv.collectRefs(repo)
 	if err != nil {
 		return caddyhttp.Error(http.StatusInternalServerError, err)
 	}
-	branches.ForEach(func(r *plumbing.Reference) error {
-		b := GitRef{
-			Hash: r.Hash().String(),
-			Type: r.Type().String(),
-			Name: r.Name().Short(),
-		}
-		gb.Branches = append(gb.Branches, b)
-		return nil
-	})
 
-	// Extract tags
-	tags, err := repo.Tags()
+	gb.Empty = len(gb.Branches) == 0 && len(gb.Tags) == 0
+
+	// Resolve the ref the page is displaying, an empty repository has none
+	// A 'ref' query parameter that doesn't resolve is a bad request, the page itself exists
+	refHash, err := gsrv.resolveBrowserRef(repo, repoName, r.URL.Query().Get("ref"), &gb)
 	if err != nil {
-		return caddyhttp.Error(http.StatusInternalServerError, err)
+		return caddyhttp.Error(http.StatusBadRequest, err)
 	}
-	tags.ForEach(func(r *plumbing.Reference) error {
-		t := GitRef{
-			Hash: r.Hash().String(),
-			Type: r.Type().String(),
-			Name: r.Name().Short(),
-		}
-		gb.Tags = append(gb.Tags, t)
+
+	// Terminal clients can ask for some pages as plain text
+	textTemplate := textPage(pageName, r)
+	w.Header().Add("Vary", "Accept")
+
+	// Pages only change when the refs do, so clients can reuse a page they already have
+	etag := gsrv.browserETag(repo, repoName, &gb, r, textTemplate != nil)
+	w.Header().Set("ETag", etag)
+	if notModified(r, etag, time.Time{}) {
+		w.WriteHeader(http.StatusNotModified)
 		return nil
-	})
+	}
 
-	if pageName == "log" {
+	if pageName == "home" {
+		// Summarize the size of the repository
+		stats := gsrv.statsCache.get(repoPath)
+		gb.RepoSize = stats.size
+		gb.ObjectCount = stats.objects
+
+		gb.BranchCount = len(gb.Branches)
+		gb.TagCount = len(gb.Tags)
+
+		// Compare the displayed ref to the default branch, a history too long to walk is left out
+		if head, err := gsrv.repoHead(repo, repoName); err == nil && refHash != nil && *refHash != head.Hash() {
+			counts, err := gsrv.aheadBehind(repo, *refHash, head.Hash())
+			if err == nil {
+				gb.AheadBehind = &GitAheadBehind{Base: head.Name().Short(), Ahead: counts.ahead, Behind: counts.behind}
+			} else {
+				gsrv.logger.Debug("could not compare ref to the default branch",
+					zap.String("git_repo", repoPath),
+					zap.String("ref", gb.CurrentRef),
+					zap.Error(err),
+				)
+			}
+		}
+
+	} else if pageName == "log" {
 		// Extract commits if needed
-		ref, err := repo.Head()
-		if err == nil {
-			commits, _ := repo.Log(&git.LogOptions{From: ref.Hash()})
-			commits.ForEach(func(c *object.Commit) error {
-				commit := GitCommit{
-					Hash:      c.Hash.String(),
-					Author:    c.Author.String(),
-					Committer: c.Committer.String(),
-					Message:   c.Message,
-					Date:      c.Author.When.String(),
-				}
-				gb.Commits = append(gb.Commits, commit)
-				return nil
-			})
+		// The page is selected with the 'page' query parameter, starting at 1
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+		pageSize := gsrv.LogPageSize
+		offset := (page - 1) * pageSize
+
+		// Walk one commit past the page to find out if there is a next page,
+		// but never past the configured log limit
+		count := pageSize + 1
+		if gsrv.LogLimit > 0 && offset+count > gsrv.LogLimit {
+			count = gsrv.LogLimit - offset
+		}
+
+		// The log can be limited to the history of a file or directory with the 'path' query parameter
+		var filter commitFilter
+		if logPath := r.URL.Query().Get("path"); logPath != "" {
+			filter.path = strings.Trim(path.Clean("/"+logPath), "/")
+			gb.LogPath = filter.path
+		}
+		// or to the commits of an author with the 'author' query parameter
+		if author := strings.TrimSpace(r.URL.Query().Get("author")); author != "" {
+			filter.author = strings.ToLower(author)
+			gb.LogAuthor = author
+		}
+
+		// A filtered log visits commits that aren't listed, the walk is bounded by the commits visited
+		walkLimit := gsrv.LogLimit
+		if walkLimit == 0 && filter != (commitFilter{}) {
+			walkLimit = logFilterMaxCommits
+		}
+
+		if refHash != nil && count > 0 {
+			commits, truncated, _ := getCommitLog(repo, *refHash, filter, offset, count, walkLimit)
+			gb.LogTruncated = truncated && filter != (commitFilter{})
+			if len(commits) > pageSize {
+				commits = commits[:pageSize]
+				gb.NextPage = page + 1
+			}
+			for _, c := range commits {
+				gc := gsrv.newGitCommit(c)
+				gsrv.verifyCommit(c, &gc)
+				gb.Commits = append(gb.Commits, gc)
+			}
+		}
+		gb.PageNumber = page
+		if page > 1 {
+			gb.PrevPage = page - 1
 		}
 
 	} else if pageName == "tree" {
-		// Get list of files if needed
-		ref, err := repo.Head()
-		if err == nil {
-			refCommit, _ := repo.CommitObject(ref.Hash())
-			tree, _ := refCommit.Tree()
+		// Get list of files if needed. The last commit of each entry is found by walking
+		// the history, so repositories without a commit-graph file are listed the same way.
+		if refHash != nil {
+			refCommit, err := repo.CommitObject(*refHash)
+			if err != nil {
+				return caddyhttp.Error(http.StatusNotFound, err)
+			}
+			tree, err := refCommit.Tree()
+			if err != nil {
+				return caddyhttp.Error(http.StatusInternalServerError, err)
+			}
+			submodules := readSubmoduleURLs(tree)
+			lastCommits := lastEntryCommits(refCommit, tree)
 			for _, entry := range tree.Entries {
 				f := GitFile{
-					Name:   entry.Name,
-					Mode:   entry.Mode.String(),
-					Commit: GitCommit{Message: "Initial Commit - Added all files."},
+					Name: entry.Name,
+					Mode: entry.Mode.String(),
+				}
+				if c, ok := lastCommits[entry.Name]; ok {
+					f.Commit = gsrv.newGitCommit(c)
+					f.Updated = gsrv.formatDate(c.Committer.When)
+				}
+				if entry.Mode.IsFile() {
+					if blob, err := repo.BlobObject(entry.Hash); err == nil {
+						f.Size = blob.Size
+					}
+				}
+				// The blob of a symlink holds the path it points to
+				if entry.Mode == filemode.Symlink {
+					f.SymlinkTarget, _ = readSymlinkTarget(repo, entry.Hash)
+				}
+				// Submodules have no blob, they point at a commit in another repository
+				if entry.Mode == filemode.Submodule {
+					f.Mode = "submodule"
+					f.SubmoduleURL = submodules[entry.Name]
+					f.SubmoduleLink = submoduleLink(f.SubmoduleURL, gb.CloneURL)
 				}
 				gb.Files = append(gb.Files, f)
 			}
+			sortFiles(gb.Files)
+
+			// The whole tree is only walked on request, e.g. for a file sidebar
+			if r.URL.Query().Get("recursive") == "1" {
+				gb.FileTree, gb.FileTreeTruncated, err = buildFileTree(repo, tree)
+				if err != nil {
+					return caddyhttp.Error(http.StatusInternalServerError, err)
+				}
+			}
+		}
+
+	} else if pageName == "commit" {
+		// Load the requested commit and the diff against its first parent
+		commitHash, _, _ := strings.Cut(pageArgs, "/")
+		hash, err := gsrv.resolveRevision(repo, commitHash)
+		if err != nil {
+			return caddyhttp.Error(revisionStatus(err), err)
+		}
+		c, err := repo.CommitObject(*hash)
+		if err != nil {
+			return caddyhttp.Error(http.StatusNotFound, err)
+		}
+		gb.Commit = gsrv.newGitCommit(c)
+		gsrv.verifyCommit(c, &gb.Commit)
+
+		patch, err := getCommitPatch(c)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		gb.Diff = getDiffFiles(patch)
+
+	} else if pageName == "search" {
+		// Search file names in the tree
+		err := gsrv.serveSearch(repo, &gb, r)
+		if err != nil {
+			return err
+		}
+
+	} else if pageName == "blob" {
+		// Show the contents of a file
+		err := gsrv.serveBlob(repo, pageArgs, &gb)
+		if err != nil {
+			return err
+		}
+
+	} else if pageName == "compare" {
+		// Compare two revisions
+		err := gsrv.serveCompare(repo, pageArgs, &gb)
+		if err != nil {
+			return err
+		}
+
+	} else if pageName == "blame" {
+		// Find the commit that last touched each line of a file
+		err := gsrv.serveBlame(repo, pageArgs, &gb)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -298,15 +570,598 @@ func (gsrv *GitServer) serveGitBrowser(repoPath string, w http.ResponseWriter, r
 		zap.String("template_page", templatePageName),
 	)
 
+	// Render the page before anything is written, so errors can still be reported
+	var page []byte
+	if textTemplate != nil {
+		page, err = executeTemplate(r.Context(), textTemplate, gb)
+	} else {
+		page, err = executeTemplate(r.Context(), browseTemplate, gb)
+	}
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
 	// Fun with headers
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if textTemplate != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	if links := gsrv.paginationLinks(&gb, r); links != "" {
+		w.Header().Add("Link", links)
+	}
+	gsrv.addPreloadLinks(w, r)
 
-	// Write to connection
-	err = browseTemplate.Execute(w, gb)
-	if err != nil {
-		return caddyhttp.Error(http.StatusInternalServerError, err)
+	// Write to connection, compressed if the client supports it
+	out, closeOut := compressResponse(w, r)
+	defer closeOut()
+	// Unknown pages are rendered with the 404 template, they should also be reported as missing
+	if isNotFoundTemplate(templatePageName) {
+		w.WriteHeader(http.StatusNotFound)
 	}
+	out.Write(page)
 	// fmt.Fprintf(w, "<html><h1>%s</html></h1>", refString)
 
 	return nil
 }
+
+// parseBrowserPath splits the request for a repository page into the repository name, the page, and its arguments.
+// Page is determined by the path segment following the repository.
+// Any path after that is path arguments, currently only the reference
+func (gsrv *GitServer) parseBrowserPath(repoPath string, r *http.Request) (string, string, string) {
+	repoName := gsrv.repoName(repoPath, r)
+	urlPath := path.Clean("/" + gsrv.stripIgnorePrefix(r.URL.Path))
+	// The repository may be requested with its suffix, '/<repo><suffix>/<page>'
+	rest := strings.TrimPrefix(strings.TrimPrefix(urlPath, "/"), repoName)
+	rest = strings.TrimPrefix(rest, gsrv.RepoSuffix)
+	pageName, pageArgs, defined := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	if !defined && pageName == "" {
+		pageName = "home"
+	}
+	return repoName, pageName, pageArgs
+}
+
+// splitRefPath splits a '<ref>/<path>' argument string of a file page. The path is cleaned and
+// rejected if it would point outside the tree, the file is always read from the tree of the ref.
+func splitRefPath(pageArgs string) (string, string, error) {
+	refStr, filePath, _ := strings.Cut(pageArgs, "/")
+	if refStr == "" || filePath == "" {
+		return "", "", caddyhttp.Error(http.StatusNotFound, fmt.Errorf("page requires a ref and a path"))
+	}
+	cleanPath := path.Clean(filePath)
+	if strings.HasPrefix(filePath, "/") || cleanPath == ".." || strings.HasPrefix(cleanPath, "../") {
+		return "", "", caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid file path: %s", filePath))
+	}
+	return refStr, cleanPath, nil
+}
+
+// resolveBrowserRef resolves the ref a page displays and sets the current ref on gb.
+// An empty refStr uses HEAD, the returned hash is nil if HEAD does not exist yet.
+func (gsrv *GitServer) resolveBrowserRef(repo *git.Repository, name string, refStr string, gb *GitBrowser) (*plumbing.Hash, error) {
+	if refStr == "" {
+		head, err := gsrv.repoHead(repo, name)
+		if err != nil {
+			return nil, nil
+		}
+		hash := head.Hash()
+		if head.Name().IsBranch() {
+			gb.CurrentRef, gb.CurrentRefType = head.Name().Short(), "branch"
+		} else {
+			gb.CurrentRef, gb.CurrentRefType = hash.String(), "commit"
+		}
+		return &hash, nil
+	}
+
+	// Branches take precedence over tags, anything else is resolved as a revision
+	refType := "commit"
+	if _, err := repo.Reference(plumbing.NewBranchReferenceName(refStr), true); err == nil && !gsrv.isHiddenRef(plumbing.NewBranchReferenceName(refStr)) {
+		refType = "branch"
+	} else if _, err := repo.Reference(plumbing.NewTagReferenceName(refStr), true); err == nil && !gsrv.isHiddenRef(plumbing.NewTagReferenceName(refStr)) {
+		refType = "tag"
+	}
+	hash, err := gsrv.resolveRevision(repo, refStr)
+	if err != nil {
+		return nil, err
+	}
+	gb.CurrentRef, gb.CurrentRefType = refStr, refType
+	return hash, nil
+}
+
+// repoHead returns the HEAD of the repository named name. Mirrors may have no usable HEAD,
+// in that case the branch configured for the repository is used instead.
+func (gsrv *GitServer) repoHead(repo *git.Repository, name string) (*plumbing.Reference, error) {
+	head, err := repo.Head()
+	if err == nil {
+		return head, nil
+	}
+	if repoConfig, ok := gsrv.Repos[name]; ok && repoConfig.Branch != "" {
+		return repo.Reference(plumbing.NewBranchReferenceName(repoConfig.Branch), true)
+	}
+	return nil, err
+}
+
+// repoDescription returns the tagline and description of the repository named name.
+// A description configured for the repository takes precedence over its description file.
+func (gsrv *GitServer) repoDescription(name string, repoPath string) (string, string, error) {
+	if repoConfig, ok := gsrv.Repos[name]; ok && repoConfig.Description != "" {
+		tagline, description, _ := strings.Cut(repoConfig.Description, "\n")
+		return tagline, description, nil
+	}
+	return readDescription(repoPath)
+}
+
+// collectRefs returns the branches and tags of a repository that aren't hidden, sorted like the browser shows them
+func (gsrv *GitServer) collectRefs(repo *git.Repository) ([]GitRef, []GitRef, error) {
+	var branches, tags []GitRef
+
+	branchRefs, err := repo.Branches()
+	if err != nil {
+		return nil, nil, err
+	}
+	branchRefs.ForEach(func(r *plumbing.Reference) error {
+		if gsrv.isHiddenRef(r.Name()) {
+			return nil
+		}
+		b := GitRef{
+			Hash:   r.Hash().String(),
+			Type:   r.Type().String(),
+			Name:   r.Name().Short(),
+			Commit: r.Hash().String(),
+		}
+		branches = append(branches, b)
+		return nil
+	})
+
+	tagRefs, err := repo.Tags()
+	if err != nil {
+		return nil, nil, err
+	}
+	tagRefs.ForEach(func(r *plumbing.Reference) error {
+		if gsrv.isHiddenRef(r.Name()) {
+			return nil
+		}
+		target, annotated := peelTag(repo, r.Hash())
+		t := GitRef{
+			Hash:      r.Hash().String(),
+			Type:      r.Type().String(),
+			Name:      r.Name().Short(),
+			Commit:    target.String(),
+			Annotated: annotated,
+		}
+		tags = append(tags, t)
+		return nil
+	})
+
+	sortBranches(repo, branches)
+	sortTags(repo, tags)
+	return branches, tags, nil
+}
+
+// sortFiles sorts directories and submodules first, then the rest alphabetically
+func sortFiles(files []GitFile) {
+	isDir := func(f GitFile) bool {
+		return f.Mode == filemode.Dir.String() || f.Mode == "submodule"
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if isDir(files[i]) != isDir(files[j]) {
+			return isDir(files[i])
+		}
+		return files[i].Name < files[j].Name
+	})
+}
+
+// sortBranches sorts the branch HEAD points at first, then the rest alphabetically
+func sortBranches(repo *git.Repository, branches []GitRef) {
+	var headBranch string
+	if head, err := repo.Reference(plumbing.HEAD, false); err == nil && head.Type() == plumbing.SymbolicReference {
+		headBranch = head.Target().Short()
+	}
+	sort.SliceStable(branches, func(i, j int) bool {
+		if (branches[i].Name == headBranch) != (branches[j].Name == headBranch) {
+			return branches[i].Name == headBranch
+		}
+		return branches[i].Name < branches[j].Name
+	})
+}
+
+// sortTags sorts version tags first, newest version first. Other tags follow,
+// newest commit first, and tags of the same age alphabetically.
+func sortTags(repo *git.Repository, tags []GitRef) {
+	versions := make(map[string]*semver.Version, len(tags))
+	dates := make(map[string]time.Time, len(tags))
+	for _, t := range tags {
+		if v, err := semver.NewVersion(t.Name); err == nil {
+			versions[t.Name] = v
+			continue
+		}
+		if c, err := repo.CommitObject(plumbing.NewHash(t.Commit)); err == nil {
+			dates[t.Name] = c.Committer.When
+		}
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool {
+		vi, vj := versions[tags[i].Name], versions[tags[j].Name]
+		switch {
+		case vi != nil && vj != nil:
+			if !vi.Equal(vj) {
+				return vi.GreaterThan(vj)
+			}
+		case vi != nil || vj != nil:
+			return vi != nil
+		default:
+			di, dj := dates[tags[i].Name], dates[tags[j].Name]
+			if !di.Equal(dj) {
+				return di.After(dj)
+			}
+		}
+		return tags[i].Name < tags[j].Name
+	})
+}
+
+// peelTag dereferences an annotated tag to the object it points at, following tags of tags.
+// Lightweight tags already point at their target, so hash is returned as is and annotated is false.
+func peelTag(repo *git.Repository, hash plumbing.Hash) (target plumbing.Hash, annotated bool) {
+	target = hash
+	for {
+		tag, err := repo.TagObject(target)
+		if err != nil {
+			return target, annotated
+		}
+		target, annotated = tag.Target, true
+	}
+}
+
+// readDescription reads the description file of a repository.
+// The first line is the tagline, the rest of the file is the long description.
+func readDescription(repoPath string) (string, string, error) {
+	// Open the description file, not every repository has one
+	file, err := os.Open(filepath.Join(repoPath, "description"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	defer file.Close()
+
+	// Read the full description file (keep it short)
+	descBytes, err := io.ReadAll(file)
+	if err != nil {
+		return "", "", caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	// Get first line as tagline, rest of file is the long description
+	tagline, description, _ := strings.Cut(string(descBytes), "\n")
+	return tagline, description, nil
+}
+
+// readSymlinkTarget reads the target path stored in a symlink blob
+func readSymlinkTarget(repo *git.Repository, hash plumbing.Hash) (string, error) {
+	blob, err := repo.BlobObject(hash)
+	if err != nil {
+		return "", err
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	// Targets are short paths, don't read more than a path could be
+	target, err := io.ReadAll(io.LimitReader(reader, 4096))
+	if err != nil {
+		return "", err
+	}
+	return string(target), nil
+}
+
+// readSubmoduleURLs maps submodule paths to their remote urls using the .gitmodules file of a tree
+func readSubmoduleURLs(tree *object.Tree) map[string]string {
+	urls := make(map[string]string)
+	file, err := tree.File(".gitmodules")
+	if err != nil {
+		return urls
+	}
+	contents, err := file.Contents()
+	if err != nil {
+		return urls
+	}
+
+	modules := config.NewModules()
+	if modules.Unmarshal([]byte(contents)) != nil {
+		return urls
+	}
+	for _, m := range modules.Submodules {
+		urls[m.Path] = m.URL
+	}
+	return urls
+}
+
+// submoduleLink turns the url of a submodule into a web address a browser can follow.
+// Relative urls like '../lib.git' are resolved against cloneURL, the url of the repository itself, like git does.
+// scp-like remotes such as 'git@host:org/repo.git' become 'https://host/org/repo'.
+// Anything that doesn't end up as an http(s) url, e.g. ssh:// or a local path, has no link.
+func submoduleLink(submoduleURL string, cloneURL string) string {
+	if strings.HasPrefix(submoduleURL, "./") || strings.HasPrefix(submoduleURL, "../") {
+		base, err := url.Parse(cloneURL + "/")
+		if err != nil {
+			return ""
+		}
+		rel, err := url.Parse(submoduleURL)
+		if err != nil {
+			return ""
+		}
+		submoduleURL = base.ResolveReference(rel).String()
+	} else if host, repoPath, ok := strings.Cut(submoduleURL, ":"); ok && !strings.Contains(submoduleURL, "://") && !strings.Contains(host, "/") {
+		// scp-like syntax, the user is only needed for ssh
+		if i := strings.LastIndex(host, "@"); i >= 0 {
+			host = host[i+1:]
+		}
+		repoPath = strings.TrimSuffix(strings.Trim(repoPath, "/"), ".git")
+		submoduleURL = "https://" + host + "/" + repoPath
+	}
+
+	u, err := url.Parse(submoduleURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
+
+// Maximum number of commits walked to find the last commit of each tree entry
+const treeHistoryLimit = 1000
+
+// lastEntryCommits finds the last commit that changed each entry of tree, the tree of commit.
+// The history is walked along first parents until every entry is found or treeHistoryLimit is reached.
+func lastEntryCommits(commit *object.Commit, tree *object.Tree) map[string]*object.Commit {
+	found := make(map[string]*object.Commit, len(tree.Entries))
+	current, currentTree := commit, tree
+	for i := 0; i < treeHistoryLimit && current != nil && len(found) < len(tree.Entries); i++ {
+		var parent *object.Commit
+		var parentTree *object.Tree
+		if p, err := current.Parent(0); err == nil {
+			if pt, err := p.Tree(); err == nil {
+				parent, parentTree = p, pt
+			}
+		}
+
+		// An entry that differs from the parent was changed by this commit, the root commit added the rest
+		for _, entry := range tree.Entries {
+			if _, ok := found[entry.Name]; ok {
+				continue
+			}
+			currentEntry, err := currentTree.FindEntry(entry.Name)
+			if err != nil || currentEntry.Hash != entry.Hash {
+				continue
+			}
+			if parentTree == nil {
+				found[entry.Name] = current
+				continue
+			}
+			if parentEntry, err := parentTree.FindEntry(entry.Name); err != nil || parentEntry.Hash != entry.Hash {
+				found[entry.Name] = current
+			}
+		}
+		current, currentTree = parent, parentTree
+	}
+	return found
+}
+
+// splitCommitMessage splits a commit message into its subject and body like git does:
+// the subject is the first paragraph unwrapped onto one line, the body is everything after the blank line.
+func splitCommitMessage(message string) (string, string) {
+	subject, body, _ := strings.Cut(strings.TrimSpace(message), "\n\n")
+	return strings.Join(strings.Fields(subject), " "), strings.TrimSpace(body)
+}
+
+// newGitCommit converts a go-git commit object into template data
+func (gsrv *GitServer) newGitCommit(c *object.Commit) GitCommit {
+	subject, body := splitCommitMessage(c.Message)
+
+	parents := make([]string, 0, len(c.ParentHashes))
+	for _, p := range c.ParentHashes {
+		parents = append(parents, p.String())
+	}
+
+	return GitCommit{
+		Hash:           c.Hash.String(),
+		AuthorName:     c.Author.Name,
+		AuthorEmail:    c.Author.Email,
+		AuthoredDate:   c.Author.When,
+		CommitterName:  c.Committer.Name,
+		CommitterEmail: c.Committer.Email,
+		CommittedDate:  c.Committer.When,
+		Author:         c.Author.String(),
+		Committer:      c.Committer.String(),
+		Message:        c.Message,
+		Subject:        subject,
+		Body:           body,
+		Date:           gsrv.formatDate(c.Author.When),
+		Parents:        parents,
+	}
+}
+
+// Maximum number of commits a filtered log page walks to find matching commits, unless LogLimit is set
+const logFilterMaxCommits = 10000
+
+// commitFilter selects the commits listed by getCommitLog, the zero value lists every commit
+type commitFilter struct {
+	// Only commits that changed this file, or a file in this directory
+	path string
+	// Only commits whose lowercase author name or email contains this
+	author string
+}
+
+// matches reports whether the author of c passes the filter, the path is filtered by the log itself
+func (f commitFilter) matches(c *object.Commit) bool {
+	if f.author == "" {
+		return true
+	}
+	return strings.Contains(strings.ToLower(c.Author.Name), f.author) ||
+		strings.Contains(strings.ToLower(c.Author.Email), f.author)
+}
+
+// changedPath reports whether c changed the file or directory at p. A merge only changed it
+// if it differs from every parent, like the default history simplification of 'git log <path>'.
+func changedPath(c *object.Commit, p string) (bool, error) {
+	hash, err := pathHash(c, p)
+	if err != nil {
+		return false, err
+	}
+	if c.NumParents() == 0 {
+		return !hash.IsZero(), nil
+	}
+	parents := c.Parents()
+	defer parents.Close()
+	changed := true
+	err = parents.ForEach(func(parent *object.Commit) error {
+		parentHash, err := pathHash(parent, p)
+		if err != nil {
+			return err
+		}
+		if parentHash == hash {
+			changed = false
+			return storer.ErrStop
+		}
+		return nil
+	})
+	return changed, err
+}
+
+// pathHash returns the hash of the tree entry at p in the tree of c, the zero hash if there is none
+func pathHash(c *object.Commit, p string) (plumbing.Hash, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	entry, err := tree.FindEntry(p)
+	if errors.Is(err, object.ErrEntryNotFound) || errors.Is(err, object.ErrDirectoryNotFound) {
+		return plumbing.ZeroHash, nil
+	} else if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return entry.Hash, nil
+}
+
+// getCommitLog walks the commit history starting at from, skipping the first offset commits that match filter.
+// At most limit commits are returned, a limit of 0 walks the whole history. The walk stops after walkLimit
+// commits, matching or not, so a filter that matches nothing doesn't walk the whole history.
+// truncated reports that the walk stopped there. A walkLimit of 0 walks until limit commits matched.
+func getCommitLog(repo *git.Repository, from plumbing.Hash, filter commitFilter, offset int, limit int, walkLimit int) (commits []*object.Commit, truncated bool, err error) {
+	commitIter, err := repo.Log(&git.LogOptions{From: from})
+	if err != nil {
+		return nil, false, err
+	}
+	defer commitIter.Close()
+
+	walked := 0
+	err = commitIter.ForEach(func(c *object.Commit) error {
+		if walkLimit > 0 && walked >= walkLimit {
+			truncated = true
+			return storer.ErrStop
+		}
+		walked++
+
+		if !filter.matches(c) {
+			return nil
+		}
+		if filter.path != "" {
+			changed, err := changedPath(c, filter.path)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				return nil
+			}
+		}
+		if offset > 0 {
+			offset--
+			return nil
+		}
+		commits = append(commits, c)
+		if limit > 0 && len(commits) >= limit {
+			return storer.ErrStop
+		}
+		return nil
+	})
+	return commits, truncated, err
+}
+
+// browserETag computes the ETag of a browser page. It covers the requested page and whether it is rendered as text,
+// the HEAD branch, the repository refs, and the description. The ETag is weak: the same page is sent gzipped or not,
+// and pages show when they were rendered.
+// There is no Last-Modified, no date in the repository says when a page last changed.
+func (gsrv *GitServer) browserETag(repo *git.Repository, repoName string, gb *GitBrowser, r *http.Request, text bool) string {
+	h := sha1.New()
+	io.WriteString(h, r.URL.Path+"?"+r.URL.RawQuery+"\n")
+	if text {
+		io.WriteString(h, "text\n")
+	}
+
+	if head, err := gsrv.repoHead(repo, repoName); err == nil {
+		io.WriteString(h, head.Name().String()+" "+head.Hash().String()+"\n")
+	}
+	for _, ref := range append(gb.Branches, gb.Tags...) {
+		io.WriteString(h, ref.Hash+" "+ref.Name+"\n")
+	}
+	io.WriteString(h, gb.Tagline+"\n"+gb.Description)
+
+	return "W/\"" + hex.EncodeToString(h.Sum(nil)) + "\""
+}
+
+// paginationLinks returns a Link header value pointing at the first, previous, next, and last
+// pages of a paginated page, or an empty string for pages that aren't paginated.
+func (gsrv *GitServer) paginationLinks(gb *GitBrowser, r *http.Request) string {
+	if gb.PageNumber == 0 {
+		return ""
+	}
+
+	pageURL := func(page int) string {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(page))
+		return gsrv.publicBaseURL(r) + r.URL.Path + "?" + query.Encode()
+	}
+
+	var links []string
+	for _, l := range []struct {
+		rel  string
+		page int
+	}{
+		{"first", 1},
+		{"prev", gb.PrevPage},
+		{"next", gb.NextPage},
+		{"last", gb.LastPage},
+	} {
+		if l.page > 0 {
+			links = append(links, fmt.Sprintf("<%s>; rel=\"%s\"", pageURL(l.page), l.rel))
+		}
+	}
+	return strings.Join(links, ", ")
+}
+
+// notModified reports whether the client already has the current version of a page.
+// If-None-Match takes precedence over If-Modified-Since, like net/http.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	// If-None-Match uses the weak comparison, a weak ETag matches the same tag sent back with or without 'W/'
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag = strings.TrimPrefix(etag, "W/")
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == etag || t == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err == nil && !lastModified.Truncate(time.Second).After(t) {
+			return true
+		}
+	}
+	return false
+}
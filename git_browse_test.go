@@ -0,0 +1,27 @@
+package gitserver
+
+import "testing"
+
+func TestSubmoduleLink(t *testing.T) {
+	const cloneURL = "https://git.example.com/org/proj.git"
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://github.com/org/lib.git", "https://github.com/org/lib.git"},
+		{"git@github.com:org/lib.git", "https://github.com/org/lib"},
+		{"github.com:org/lib", "https://github.com/org/lib"},
+		{"../lib.git", "https://git.example.com/org/lib.git"},
+		{"../../other/lib.git", "https://git.example.com/other/lib.git"},
+		{"./lib", "https://git.example.com/org/proj.git/lib"},
+		{"ssh://git@github.com/org/lib.git", ""},
+		{"git://github.com/org/lib.git", ""},
+		{"/srv/git/lib.git", ""},
+		{"file:///srv/git/lib.git", ""},
+	}
+	for _, tt := range tests {
+		if got := submoduleLink(tt.url, cloneURL); got != tt.want {
+			t.Errorf("submoduleLink(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package gitserver
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// loadClientCAs reads the PEM encoded certificates in ClientCA that client certificates have to be signed by
+func (gsrv *GitServer) loadClientCAs() error {
+	if gsrv.ClientCA == "" {
+		return nil
+	}
+	pem, err := os.ReadFile(gsrv.ClientCA)
+	if err != nil {
+		return fmt.Errorf("reading client_ca: %v", err)
+	}
+	gsrv.clientCAs = x509.NewCertPool()
+	if !gsrv.clientCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in client_ca: %s", gsrv.ClientCA)
+	}
+	return nil
+}
+
+// authorizeClientCert checks the TLS client certificate of a request against the ClientCA and ClientCNs.
+// Without a ClientCA the certificate has to be verified by Caddy's TLS client auth,
+// an unverified certificate could claim any common name.
+func (gsrv *GitServer) authorizeClientCert(r *http.Request) error {
+	if gsrv.clientCAs == nil && len(gsrv.ClientCNs) == 0 {
+		return nil
+	}
+
+	deny := func(reason string) error {
+		gsrv.logger.Info("client certificate rejected",
+			zap.String("client_ip", gsrv.clientIP(r)),
+			zap.String("req_path", r.URL.Path),
+			zap.String("reason", reason),
+		)
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("client certificate rejected: %s", reason))
+	}
+
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return deny("no client certificate")
+	}
+
+	leaf := r.TLS.PeerCertificates[0]
+	if gsrv.clientCAs != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range r.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         gsrv.clientCAs,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			return deny(err.Error())
+		}
+	} else if len(r.TLS.VerifiedChains) == 0 {
+		return deny("client certificate not verified")
+	}
+
+	if len(gsrv.ClientCNs) > 0 {
+		for _, cn := range gsrv.ClientCNs {
+			if leaf.Subject.CommonName == cn {
+				return nil
+			}
+		}
+		return deny(fmt.Sprintf("common name '%s' not allowed", leaf.Subject.CommonName))
+	}
+	return nil
+}
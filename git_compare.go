@@ -0,0 +1,290 @@
+package gitserver
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+const (
+	// Maximum number of ahead/behind results kept in the cache
+	aheadBehindCacheSize = 256
+	// Histories that diverged more than this many commits ago aren't compared, the home page leaves the comparison out
+	aheadBehindMaxCommits = 2000
+)
+
+var errHistoryTooLong = errors.New("history too long to compare")
+
+// GitAheadBehind compares the ref shown on the home page to the default branch
+type GitAheadBehind struct {
+	// Name of the default branch
+	Base string
+	// Commits on the ref that aren't on the default branch
+	Ahead int
+	// Commits on the default branch that aren't on the ref
+	Behind int
+}
+
+type aheadBehindCounts struct {
+	ahead  int
+	behind int
+	// The comparison failed, e.g. with errHistoryTooLong, and isn't tried again
+	err error
+}
+
+// aheadBehindCache holds the counts for pairs of commits, it is cleared once it grows past aheadBehindCacheSize.
+// Commits never change, so the counts, or the failure to count them, never have to be computed again.
+type aheadBehindCache struct {
+	mu      sync.Mutex
+	entries map[string]aheadBehindCounts
+}
+
+func (ac *aheadBehindCache) get(key string) (aheadBehindCounts, bool) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	counts, ok := ac.entries[key]
+	return counts, ok
+}
+
+func (ac *aheadBehindCache) put(key string, counts aheadBehindCounts) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.entries == nil || len(ac.entries) >= aheadBehindCacheSize {
+		ac.entries = make(map[string]aheadBehindCounts)
+	}
+	ac.entries[key] = counts
+}
+
+func (ac *aheadBehindCache) clear() {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.entries = nil
+}
+
+// aheadBehind counts the commits reachable from ref but not from base, and the other way around.
+// Both are counted down to the merge base of the two, so only the commits that differ are walked.
+func (gsrv *GitServer) aheadBehind(repo *git.Repository, ref plumbing.Hash, base plumbing.Hash) (aheadBehindCounts, error) {
+	cacheKey := ref.String() + ":" + base.String()
+	if counts, ok := gsrv.aheadBehindCache.get(cacheKey); ok {
+		return counts, counts.err
+	}
+
+	refCommit, err := repo.CommitObject(ref)
+	if err != nil {
+		return aheadBehindCounts{}, err
+	}
+	baseCommit, err := repo.CommitObject(base)
+	if err != nil {
+		return aheadBehindCounts{}, err
+	}
+
+	result, err := divergenceWalk(refCommit, baseCommit, aheadBehindMaxCommits, nil)
+	if err != nil && !errors.Is(err, errHistoryTooLong) {
+		return aheadBehindCounts{}, err
+	}
+	counts := aheadBehindCounts{ahead: result.left, behind: result.right, err: err}
+
+	gsrv.aheadBehindCache.put(cacheKey, counts)
+	return counts, counts.err
+}
+
+// Sides of a divergence walk a commit is reachable from, and whether it is reachable from a merge base
+const (
+	divergeLeft = 1 << iota
+	divergeRight
+	divergeStale
+)
+
+// divergence is the result of divergenceWalk
+type divergence struct {
+	// Newest commit reachable from both sides, nil if they have no common history
+	mergeBase *object.Commit
+	// Number of commits only reachable from the left side, and from the right side
+	left  int
+	right int
+}
+
+// commitQueue orders commits newest first by commit date, like git's revision walk
+type commitQueue []*object.Commit
+
+func (q commitQueue) Len() int            { return len(q) }
+func (q commitQueue) Less(i, j int) bool  { return q[i].Committer.When.After(q[j].Committer.When) }
+func (q commitQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x interface{}) { *q = append(*q, x.(*object.Commit)) }
+func (q *commitQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// divergenceWalk walks the histories of left and right newest first until it reaches their merge base,
+// like 'git merge-base' and 'git rev-list --left-right left...right'. onLeft is called, newest first,
+// for each commit only reachable from left, and can return storer.ErrStop to stop listing them.
+// At most maxCommits commits are visited, the walk returns errHistoryTooLong if it needed more.
+// Commit dates are trusted to be in order, a commit dated before its parent can be counted on the wrong side.
+func divergenceWalk(left *object.Commit, right *object.Commit, maxCommits int, onLeft func(*object.Commit) error) (divergence, error) {
+	var result divergence
+	flags := map[plumbing.Hash]int{left.Hash: divergeLeft}
+	flags[right.Hash] |= divergeRight
+	queue := &commitQueue{left}
+	if right.Hash != left.Hash {
+		heap.Push(queue, right)
+	}
+	done := make(map[plumbing.Hash]int)
+
+	visited := 0
+	for queue.Len() > 0 {
+		// Once only commits reachable from the merge base are left, nothing else can differ
+		active := false
+		for _, c := range *queue {
+			if flags[c.Hash]&divergeStale == 0 {
+				active = true
+				break
+			}
+		}
+		if !active {
+			break
+		}
+
+		c := heap.Pop(queue).(*object.Commit)
+		f := flags[c.Hash]
+		// A commit is queued again when it gets more flags, it only has to be visited once with each set
+		if prev, ok := done[c.Hash]; ok && prev == f {
+			continue
+		}
+		done[c.Hash] = f
+
+		visited++
+		if visited > maxCommits {
+			return divergence{}, errHistoryTooLong
+		}
+
+		if f&divergeStale == 0 {
+			switch f & (divergeLeft | divergeRight) {
+			case divergeLeft | divergeRight:
+				// Reachable from both, and not from an earlier merge base: the newest one is the merge base
+				if result.mergeBase == nil {
+					result.mergeBase = c
+				}
+				f |= divergeStale
+				flags[c.Hash] = f
+			case divergeLeft:
+				result.left++
+				if onLeft != nil {
+					err := onLeft(c)
+					if err == storer.ErrStop {
+						onLeft = nil
+					} else if err != nil {
+						return divergence{}, err
+					}
+				}
+			case divergeRight:
+				result.right++
+			}
+		}
+
+		err := c.Parents().ForEach(func(p *object.Commit) error {
+			pf := flags[p.Hash] | f
+			if pf != flags[p.Hash] {
+				flags[p.Hash] = pf
+				heap.Push(queue, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return divergence{}, err
+		}
+	}
+	return result, nil
+}
+
+const (
+	// Maximum number of commits listed on the compare page
+	compareMaxCommits = 250
+	// Maximum number of commits the compare page walks to find where the revisions diverged
+	compareMaxWalk = 10000
+	// Maximum number of changed files diffed on the compare page
+	compareMaxFiles = 300
+)
+
+// serveCompare populates the compare page for a '<base>...<head>' argument string.
+// It lists the commits on head that aren't on base, and the changes head made since the two diverged.
+func (gsrv *GitServer) serveCompare(repo *git.Repository, pageArgs string, gb *GitBrowser) error {
+	baseStr, headStr, ok := strings.Cut(pageArgs, "...")
+	if !ok || baseStr == "" || headStr == "" {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("compare needs '<base>...<head>', got '%s'", pageArgs))
+	}
+	gb.CompareBase, gb.CompareHead = baseStr, headStr
+
+	baseHash, err := gsrv.resolveRevision(repo, baseStr)
+	if err != nil {
+		return caddyhttp.Error(revisionStatus(err), err)
+	}
+	headHash, err := gsrv.resolveRevision(repo, headStr)
+	if err != nil {
+		return caddyhttp.Error(revisionStatus(err), err)
+	}
+	baseCommit, err := repo.CommitObject(*baseHash)
+	if err != nil {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+	headCommit, err := repo.CommitObject(*headHash)
+	if err != nil {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+
+	// The commits on head that aren't on base, and the merge base the changes are diffed from, like 'git diff base...head'
+	result, err := divergenceWalk(headCommit, baseCommit, compareMaxWalk, func(c *object.Commit) error {
+		if len(gb.Commits) >= compareMaxCommits {
+			gb.CompareTruncated = true
+			return storer.ErrStop
+		}
+		gc := gsrv.newGitCommit(c)
+		gsrv.verifyCommit(c, &gc)
+		gb.Commits = append(gb.Commits, gc)
+		return nil
+	})
+	if errors.Is(err, errHistoryTooLong) {
+		return caddyhttp.Error(http.StatusBadRequest, &pageError{fmt.Sprintf("'%s' and '%s' diverged more than %d commits ago, too long to compare", baseStr, headStr, compareMaxWalk)})
+	} else if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	if result.mergeBase == nil {
+		return caddyhttp.Error(http.StatusBadRequest, &pageError{fmt.Sprintf("'%s' and '%s' have no common history", baseStr, headStr)})
+	}
+	gb.CompareMergeBase = result.mergeBase.Hash.String()
+
+	// Only the first compareMaxFiles changed files are diffed
+	mergeTree, err := result.mergeBase.Tree()
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	headTree, err := headCommit.Tree()
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	changes, err := object.DiffTree(mergeTree, headTree)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	if len(changes) > compareMaxFiles {
+		changes = changes[:compareMaxFiles]
+		gb.CompareDiffTruncated = true
+	}
+	patch, err := changes.Patch()
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	gb.Diff = getDiffFiles(patch)
+	return nil
+}
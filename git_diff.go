@@ -0,0 +1,202 @@
+package gitserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Number of unchanged lines shown around each change in a hunk
+const diffContextLines = 3
+
+type GitDiffFile struct {
+	// Path of the file before the change, empty if the file was added
+	From string
+	// Path of the file after the change, empty if the file was deleted
+	To string
+	// Binary files have no hunks
+	IsBinary bool
+
+	Hunks []GitDiffHunk
+}
+
+type GitDiffHunk struct {
+	// Unified diff hunk header, e.g. '@@ -1,4 +1,5 @@'
+	Header string
+
+	Lines []GitDiffLine
+}
+
+type GitDiffLine struct {
+	// Line type, one of 'add', 'del', or 'ctx'
+	Type string
+	// Line contents without the trailing newline
+	Content string
+	// Line number in the old file, 0 for added lines
+	OldLine int
+	// Line number in the new file, 0 for deleted lines
+	NewLine int
+}
+
+// getCommitPatch computes the patch introduced by a commit. Commits are compared
+// against their first parent, root commits are compared against the empty tree.
+func getCommitPatch(commit *object.Commit) (*object.Patch, error) {
+	if commit.NumParents() == 0 {
+		tree, err := commit.Tree()
+		if err != nil {
+			return nil, err
+		}
+		changes, err := object.DiffTree(nil, tree)
+		if err != nil {
+			return nil, err
+		}
+		return changes.Patch()
+	}
+
+	parent, err := commit.Parent(0)
+	if err != nil {
+		return nil, err
+	}
+	return parent.Patch(commit)
+}
+
+// getDiffFiles converts a go-git patch into per-file hunks for the templates
+func getDiffFiles(patch *object.Patch) []GitDiffFile {
+	var files []GitDiffFile
+	for _, fp := range patch.FilePatches() {
+		from, to := fp.Files()
+		f := GitDiffFile{IsBinary: fp.IsBinary()}
+		if from != nil {
+			f.From = from.Path()
+		}
+		if to != nil {
+			f.To = to.Path()
+		}
+		if !f.IsBinary {
+			f.Hunks = buildHunks(diffLines(fp.Chunks()), diffContextLines)
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// diffLines flattens patch chunks into numbered lines
+func diffLines(chunks []diff.Chunk) []GitDiffLine {
+	var lines []GitDiffLine
+	oldLine, newLine := 0, 0
+	for _, chunk := range chunks {
+		if chunk.Content() == "" {
+			continue
+		}
+		content := strings.TrimSuffix(chunk.Content(), "\n")
+		for _, l := range strings.Split(content, "\n") {
+			line := GitDiffLine{Content: l}
+			switch chunk.Type() {
+			case diff.Add:
+				newLine++
+				line.Type = "add"
+				line.NewLine = newLine
+			case diff.Delete:
+				oldLine++
+				line.Type = "del"
+				line.OldLine = oldLine
+			default:
+				oldLine++
+				newLine++
+				line.Type = "ctx"
+				line.OldLine = oldLine
+				line.NewLine = newLine
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// buildHunks groups changed lines into hunks surrounded by up to context unchanged lines.
+// Changes separated by no more than twice the context are merged into one hunk.
+func buildHunks(lines []GitDiffLine, context int) []GitDiffHunk {
+	var hunks []GitDiffHunk
+	n := len(lines)
+	i := 0
+	for i < n {
+		// Find the next changed line
+		for i < n && lines[i].Type == "ctx" {
+			i++
+		}
+		if i >= n {
+			break
+		}
+
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+
+		// Extend the hunk until we hit a run of unchanged lines longer than the context
+		end := i
+		for end < n {
+			if lines[end].Type != "ctx" {
+				end++
+				continue
+			}
+			j := end
+			for j < n && lines[j].Type == "ctx" {
+				j++
+			}
+			if j < n && j-end <= 2*context {
+				end = j
+				continue
+			}
+			end += context
+			if end > n {
+				end = n
+			}
+			break
+		}
+
+		hunkLines := lines[start:end]
+		hunks = append(hunks, GitDiffHunk{
+			Header: hunkHeader(lines, start, hunkLines),
+			Lines:  hunkLines,
+		})
+		i = end
+	}
+	return hunks
+}
+
+// hunkHeader builds the unified diff header for a hunk starting at index start
+func hunkHeader(lines []GitDiffLine, start int, hunk []GitDiffLine) string {
+	// Count the old and new lines before the hunk to find where it starts
+	oldStart, newStart := 1, 1
+	for _, l := range lines[:start] {
+		if l.Type != "add" {
+			oldStart++
+		}
+		if l.Type != "del" {
+			newStart++
+		}
+	}
+
+	oldCount, newCount := 0, 0
+	for _, l := range hunk {
+		if l.Type != "add" {
+			oldCount++
+		}
+		if l.Type != "del" {
+			newCount++
+		}
+	}
+
+	// An empty range starts at the line before it, like git
+	if oldCount == 0 {
+		oldStart--
+	}
+	if newCount == 0 {
+		newStart--
+	}
+
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@", oldStart, oldCount, newStart, newCount)
+}
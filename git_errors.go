@@ -0,0 +1,96 @@
+package gitserver
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// pageError is an error whose message is safe to show on the error page, e.g. why a request can't be served
+type pageError struct {
+	msg string
+}
+
+func (e *pageError) Error() string {
+	return e.msg
+}
+
+// serveErrorPage renders the error page for an error returned by serveGitBrowser, with the
+// status of the error. The original error is returned if the page can't be shown, e.g. because
+// part of the response was already written or the client asked for plain text.
+func (gsrv *GitServer) serveErrorPage(repoPath string, mw *metricsWriter, r *http.Request, err error) error {
+	if mw.status != 0 || mw.written != 0 || wantsText(r) {
+		return err
+	}
+
+	status := http.StatusInternalServerError
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(err, &handlerErr) && handlerErr.StatusCode != 0 {
+		status = handlerErr.StatusCode
+	}
+
+	repoName := gsrv.repoName(repoPath, r)
+	browseTemplate, _, _, tmplErr := gsrv.loadBrowseTemplate(repoName, "error")
+	if tmplErr != nil {
+		return err
+	}
+
+	// The error itself is only logged, internal errors can reveal paths on the server.
+	// Only errors known to be safe, like a revision that doesn't resolve, are shown.
+	gb := GitBrowser{
+		Name:        path.Base(repoName),
+		Path:        r.URL.Path,
+		Page:        "error",
+		Host:        r.Host,
+		Now:         gsrv.formatDate(time.Now().UTC()),
+		DateFormat:  gsrv.DateFormat,
+		Assets:      gsrv.staticAssets(),
+		Root:        strings.TrimPrefix(strings.Trim(gsrv.IgnorePrefix, "/")+"/"+repoName, "/"),
+		Prefix:      strings.Trim(gsrv.IgnorePrefix, "/"),
+		ErrorStatus: status,
+		ErrorText:   http.StatusText(status),
+	}
+	if namespace := path.Dir(repoName); namespace != "." {
+		gb.Namespace = namespace
+	}
+	var revErr *revisionError
+	var pageErr *pageError
+	if errors.As(err, &revErr) {
+		gb.ErrorMessage = revErr.Error()
+	} else if errors.As(err, &pageErr) {
+		gb.ErrorMessage = pageErr.Error()
+	}
+	page, tmplErr := executeTemplate(r.Context(), browseTemplate, gb)
+	if tmplErr != nil {
+		return err
+	}
+
+	if status >= 500 {
+		gsrv.logger.Error("git browser error",
+			zap.String("req_path", r.URL.Path),
+			zap.String("git_repo", repoPath),
+			zap.Int("status", status),
+			zap.Error(err),
+		)
+	} else {
+		gsrv.logger.Debug("git browser error",
+			zap.String("req_path", r.URL.Path),
+			zap.String("git_repo", repoPath),
+			zap.Int("status", status),
+			zap.Error(err),
+		)
+	}
+
+	mw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	mw.Header().Set("Cache-Control", "no-store")
+	mw.Header().Del("ETag")
+	mw.Header().Del("Last-Modified")
+	mw.WriteHeader(status)
+	_, writeErr := mw.Write(page)
+	return writeErr
+}
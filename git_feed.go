@@ -0,0 +1,105 @@
+package gitserver
+
+import (
+	"encoding/xml"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/go-git/go-git/v5"
+	"go.uber.org/zap"
+)
+
+// Number of commits included in the feed
+const feedLength = 20
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Link    atomLink    `xml:"link"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Link    atomLink    `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Content atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// serveFeed writes an Atom feed of the latest commits on the default branch of the repository named repoName
+func (gsrv *GitServer) serveFeed(repo *git.Repository, repoName string, gb *GitBrowser, w http.ResponseWriter, r *http.Request) error {
+	repoURL := gsrv.publicBaseURL(r) + "/" + gb.Root
+
+	feed := atomFeed{
+		ID:      repoURL,
+		Title:   gb.Name,
+		Link:    atomLink{Href: repoURL},
+		Updated: time.Now().UTC().Format(time.RFC3339),
+	}
+	if gb.Tagline != "" {
+		feed.Title += " - " + gb.Tagline
+	}
+
+	// An empty repository has no HEAD, so it gets an empty feed
+	ref, err := gsrv.repoHead(repo, repoName)
+	if err == nil {
+		commits, _, err := getCommitLog(repo, ref.Hash(), commitFilter{}, 0, feedLength, 0)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+
+		for i, c := range commits {
+			commitURL := repoURL + "/commit/" + c.Hash.String()
+			title, body := splitCommitMessage(c.Message)
+			entry := atomEntry{
+				ID:      commitURL,
+				Title:   title,
+				Link:    atomLink{Href: commitURL, Rel: "alternate"},
+				Updated: c.Committer.When.UTC().Format(time.RFC3339),
+				Author:  atomAuthor{Name: c.Author.Name, Email: c.Author.Email},
+				Content: atomContent{Type: "text", Body: body},
+			}
+			feed.Entries = append(feed.Entries, entry)
+
+			// The feed was last updated by the newest commit
+			if i == 0 {
+				feed.Updated = entry.Updated
+			}
+		}
+	}
+
+	gsrv.logger.Info("serving git feed",
+		zap.String("request_path", r.URL.Path),
+		zap.Int("entries", len(feed.Entries)),
+	)
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(feed)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package gitserver
+
+import (
+	"path"
+	"sort"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Maximum number of entries loaded into the recursive file tree, the rest of a larger tree is left out
+const fileTreeMaxEntries = 5000
+
+// GitTreeEntry is an entry of the recursive file tree, directories hold their own entries
+type GitTreeEntry struct {
+	Name string
+	// Path of the entry from the root of the repository
+	Path string
+	// Mode like GitFile.Mode, 'submodule' for submodules
+	Mode     string
+	Children []GitTreeEntry
+}
+
+// IsDir reports whether the entry is a directory, for templates
+func (e GitTreeEntry) IsDir() bool {
+	return e.Mode == filemode.Dir.String()
+}
+
+// buildFileTree loads every entry of tree and its subdirectories, up to fileTreeMaxEntries entries.
+// It returns true if the tree was cut off.
+func buildFileTree(repo *git.Repository, tree *object.Tree) ([]GitTreeEntry, bool, error) {
+	count := 0
+	entries, err := fileTreeEntries(repo, tree, "", &count)
+	return entries, count > fileTreeMaxEntries, err
+}
+
+// fileTreeEntries returns the entries of tree below dir, counting every entry it visits in count
+func fileTreeEntries(repo *git.Repository, tree *object.Tree, dir string, count *int) ([]GitTreeEntry, error) {
+	var entries []GitTreeEntry
+	for _, entry := range tree.Entries {
+		*count++
+		if *count > fileTreeMaxEntries {
+			break
+		}
+
+		e := GitTreeEntry{
+			Name: entry.Name,
+			Path: path.Join(dir, entry.Name),
+			Mode: entry.Mode.String(),
+		}
+		switch entry.Mode {
+		case filemode.Submodule:
+			e.Mode = "submodule"
+		case filemode.Dir:
+			subtree, err := repo.TreeObject(entry.Hash)
+			if err != nil {
+				return nil, err
+			}
+			e.Children, err = fileTreeEntries(repo, subtree, e.Path, count)
+			if err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	// Sorted like the tree page, directories and submodules first
+	sort.SliceStable(entries, func(i, j int) bool {
+		iDir := entries[i].IsDir() || entries[i].Mode == "submodule"
+		jDir := entries[j].IsDir() || entries[j].Mode == "submodule"
+		if iDir != jDir {
+			return iDir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
@@ -0,0 +1,71 @@
+package gitserver
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Page returned to 'go get', it only reads the meta tags
+var goGetTemplate = template.Must(template.New("go-get").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="go-import" content="{{.ImportPath}} git {{.CloneURL}}">
+<meta name="go-source" content="{{.ImportPath}} {{.RepoURL}} {{.RepoURL}}/tree {{.RepoURL}}/blob/HEAD{/dir}/{file}">
+</head>
+<body>
+go get {{.ImportPath}}
+</body>
+</html>
+`))
+
+// isGoGet reports whether the request was made by 'go get' resolving an import path
+func isGoGet(r *http.Request) bool {
+	return r.URL.Query().Get("go-get") == "1"
+}
+
+// serveGoGet writes the go-import and go-source meta tags for the repository named repoName,
+// so the server can be used as the host of Go import paths.
+func (gsrv *GitServer) serveGoGet(repoName string, w http.ResponseWriter, r *http.Request) error {
+	baseURL := gsrv.publicBaseURL(r)
+	// The repository is served below the ignored prefix, so the import path and urls keep it
+	repoPath := repoName
+	if gsrv.IgnorePrefix != "" {
+		repoPath = strings.Trim(gsrv.IgnorePrefix, "/") + "/" + repoPath
+	}
+	repoURL := baseURL + "/" + repoPath
+
+	// Import paths are the repository url without the scheme
+	_, importHost, found := strings.Cut(baseURL, "://")
+	if !found {
+		importHost = baseURL
+	}
+
+	data := struct {
+		ImportPath string
+		CloneURL   string
+		RepoURL    string
+	}{
+		ImportPath: importHost + "/" + repoPath,
+		CloneURL:   repoURL + gsrv.RepoSuffix,
+		RepoURL:    repoURL,
+	}
+
+	var out bytes.Buffer
+	if err := goGetTemplate.Execute(&out, data); err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	gsrv.logger.Debug("serving go-get meta tags",
+		zap.String("request_path", r.URL.Path),
+		zap.String("import_path", data.ImportPath),
+	)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err := w.Write(out.Bytes())
+	return err
+}
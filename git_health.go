@@ -0,0 +1,78 @@
+package gitserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// URL path segment the health check is served under
+const healthPathSegment = "_healthz"
+
+// healthPath returns the URL path of the health check
+func (gsrv *GitServer) healthPath() string {
+	prefix := strings.Trim(gsrv.IgnorePrefix, "/")
+	if prefix == "" {
+		return "/" + healthPathSegment
+	}
+	return "/" + prefix + "/" + healthPathSegment
+}
+
+// serveHealth reports whether the repository root can be scanned. It responds with
+// 200 if the root is a readable directory and the last scan succeeded, otherwise 503.
+func (gsrv *GitServer) serveHealth(w http.ResponseWriter, r *http.Request) error {
+	root, err := gsrv.requestRoot(r)
+	if err == nil {
+		err = checkRootReadable(root)
+	}
+	if err == nil {
+		gsrv.refreshRepositories(root)
+		_, err = gsrv.repositoryList()
+	}
+	if err == nil {
+		err = gsrv.extraRootsErr()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err != nil {
+		gsrv.logger.Warn("health check failed",
+			zap.String("root", root),
+			zap.Error(err),
+		)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "unavailable")
+		return nil
+	}
+
+	fmt.Fprintln(w, "ok")
+	return nil
+}
+
+// checkRootReadable returns an error if root is not a directory that can be listed
+func checkRootReadable(root string) error {
+	dir, err := os.Open(root)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	info, err := dir.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("root is not a directory: %s", root)
+	}
+
+	// Reading a single entry is enough to know the directory can be listed
+	if _, err := dir.Readdirnames(1); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
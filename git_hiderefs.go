@@ -0,0 +1,42 @@
+package gitserver
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// isHiddenRef reports whether a full ref name matches one of the HideRefs patterns.
+// Patterns with glob characters are matched with path.Match, any other pattern hides
+// the ref with that name and every ref below it, like git's uploadpack.hideRefs.
+func (gsrv *GitServer) isHiddenRef(name plumbing.ReferenceName) bool {
+	for _, pattern := range gsrv.HideRefs {
+		if strings.ContainsAny(pattern, "*?[") {
+			if ok, _ := path.Match(pattern, name.String()); ok {
+				return true
+			}
+			continue
+		}
+		pattern = strings.TrimSuffix(pattern, "/")
+		if name.String() == pattern || strings.HasPrefix(name.String(), pattern+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isHiddenRevision reports whether the ref a revision starts at is hidden.
+// The ref is looked up with the same rules go-git uses.
+func (gsrv *GitServer) isHiddenRevision(repo *git.Repository, refPart string) bool {
+	for _, rule := range append([]string{"%s"}, plumbing.RefRevParseRules...) {
+		name := plumbing.ReferenceName(fmt.Sprintf(rule, refPart))
+		if _, err := storer.ResolveReference(repo.Storer, name); err == nil {
+			return gsrv.isHiddenRef(name)
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package gitserver
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/go-git/go-git/v5"
+	"go.uber.org/zap"
+)
+
+// serveRepoIndex renders the index page listing every repository in the root,
+// or only the repositories in a namespace directory if namespace is set
+func (gsrv *GitServer) serveRepoIndex(namespace string, w http.ResponseWriter, r *http.Request) error {
+	root, err := gsrv.requestRoot(r)
+	if err != nil {
+		return err
+	}
+
+	browseTemplate, templateBaseName, templatePageName, err := gsrv.loadBrowseTemplate("", "index")
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	prefix := strings.Trim(gsrv.IgnorePrefix, "/")
+	gb := GitBrowser{
+		Name:       r.Host,
+		Path:       r.URL.Path,
+		Page:       "index",
+		Host:       r.Host,
+		Now:        gsrv.formatDate(time.Now().UTC()),
+		DateFormat: gsrv.DateFormat,
+		Assets:     gsrv.staticAssets(),
+		Root:       prefix,
+		Prefix:     prefix,
+		Namespace:  namespace,
+	}
+
+	for _, name := range gsrv.repositoryNames() {
+		if namespace != "" && !strings.HasPrefix(name, namespace+"/") {
+			continue
+		}
+		repoPath := gsrv.resolveRepoPath(root, name)
+		gr := GitRepo{
+			Name: name,
+			URL:  "/" + strings.TrimPrefix(prefix+"/"+name, "/"),
+		}
+
+		// A missing description shouldn't hide the repository
+		gr.Tagline, gr.Description, _ = gsrv.repoDescription(name, repoPath)
+
+		// Last updated is the date of the latest commit on HEAD
+		repo, err := git.PlainOpen(repoPath)
+		if err != nil {
+			gsrv.logger.Warn("could not open repository for index",
+				zap.String("git_repo", repoPath),
+				zap.Error(err),
+			)
+			continue
+		}
+		head, err := gsrv.repoHead(repo, name)
+		if err == nil {
+			headCommit, err := repo.CommitObject(head.Hash())
+			if err == nil {
+				gr.Updated = gsrv.formatDate(headCommit.Committer.When)
+			}
+		}
+
+		gb.Repositories = append(gb.Repositories, gr)
+	}
+
+	gsrv.logger.Info("serving git repository index",
+		zap.String("request_path", r.URL.Path),
+		zap.String("namespace", namespace),
+		zap.Int("repositories", len(gb.Repositories)),
+		zap.String("template_base", templateBaseName),
+		zap.String("template_page", templatePageName),
+	)
+
+	// Render the page before anything is written, so errors can still be reported
+	page, err := executeTemplate(r.Context(), browseTemplate, gb)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	gsrv.addPreloadLinks(w, r)
+
+	// Write to connection, compressed if the client supports it
+	out, closeOut := compressResponse(w, r)
+	defer closeOut()
+	out.Write(page)
+
+	return nil
+}
+
+// repositoryNames lists the repositories scanned in every root together with the ones registered with an explicit path, sorted by name
+func (gsrv *GitServer) repositoryNames() []string {
+	repositories, _ := gsrv.repositoryList()
+	names := append([]string{}, repositories...)
+	scanned := make(map[string]bool, len(names))
+	for _, name := range names {
+		scanned[name] = true
+	}
+	for _, scan := range gsrv.extraScanList() {
+		for _, name := range scan.repositories {
+			if !scanned[name] {
+				scanned[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	for name, repoConfig := range gsrv.Repos {
+		if repoConfig.Path != "" && !scanned[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// namespacePath returns the namespace a request is for, a directory in the root that contains
+// repositories but isn't one itself. An empty string is returned if it isn't a namespace.
+func (gsrv *GitServer) namespacePath(urlPath string) string {
+	namespace := strings.Trim(path.Clean("/"+gsrv.stripIgnorePrefix(urlPath)), "/")
+	if namespace == "" {
+		return ""
+	}
+	for _, name := range gsrv.repositoryNames() {
+		if strings.HasPrefix(name, namespace+"/") {
+			return namespace
+		}
+	}
+	return ""
+}
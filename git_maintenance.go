@@ -0,0 +1,67 @@
+package gitserver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Seconds clients are told to wait before retrying during maintenance
+const maintenanceRetryAfter = 300
+
+// Notice shown during maintenance when no message is configured
+const defaultMaintenanceMessage = "Down for maintenance, please try again later."
+
+// serveMaintenance responds with a 503 while maintenance mode is on.
+// Browsers get the maintenance page, git clients and failed renders get the message as plain text.
+func (gsrv *GitServer) serveMaintenance(w http.ResponseWriter, r *http.Request) error {
+	message := gsrv.MaintenanceMessage
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if gsrv.Browse && !isGitClient(r) {
+		page, err := gsrv.renderMaintenancePage(message, r)
+		if err == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, err = w.Write(page)
+			return err
+		}
+		gsrv.logger.Warn("could not render maintenance page", zap.Error(err))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, err := fmt.Fprintln(w, message)
+	return err
+}
+
+// renderMaintenancePage renders the maintenance page with the layout of the index page
+func (gsrv *GitServer) renderMaintenancePage(message string, r *http.Request) ([]byte, error) {
+	browseTemplate, _, _, err := gsrv.loadBrowseTemplate("", "maintenance")
+	if err != nil {
+		return nil, err
+	}
+
+	gb := GitBrowser{
+		Name:               r.Host,
+		Path:               r.URL.Path,
+		Page:               "index",
+		Host:               r.Host,
+		Now:                gsrv.formatDate(time.Now().UTC()),
+		DateFormat:         gsrv.DateFormat,
+		Assets:             gsrv.staticAssets(),
+		Root:               strings.Trim(gsrv.IgnorePrefix, "/"),
+		Prefix:             strings.Trim(gsrv.IgnorePrefix, "/"),
+		MaintenanceMessage: message,
+	}
+	return executeTemplate(r.Context(), browseTemplate, gb)
+}
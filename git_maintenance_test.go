@@ -0,0 +1,73 @@
+package gitserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// nextHandler records whether a request was passed on
+type nextHandler struct {
+	called bool
+}
+
+func (h *nextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	h.called = true
+	return nil
+}
+
+func TestMaintenanceOnlyCoversRepositories(t *testing.T) {
+	dir, run := testRepo(t)
+	root := t.TempDir()
+	run("clone", "-q", "--bare", dir, filepath.Join(root, "demo.git"))
+
+	gsrv := &GitServer{
+		Root:           root,
+		RepoSuffix:     ".git",
+		Browse:         true,
+		Maintenance:    true,
+		logger:         zap.NewNop(),
+		repositoriesMu: &sync.RWMutex{},
+		templateCache:  &templateCache{},
+	}
+
+	tests := []struct {
+		path      string
+		userAgent string
+		status    int
+	}{
+		{"/demo.git/info/refs", "git/2.40.0", http.StatusServiceUnavailable},
+		{"/demo/info/refs", "git/2.40.0", http.StatusServiceUnavailable},
+		{"/missing.git/info/refs", "git/2.40.0", http.StatusNotFound},
+		{"/demo", "Mozilla/5.0", http.StatusServiceUnavailable},
+		{"/", "Mozilla/5.0", http.StatusServiceUnavailable},
+		{"/other/page.html", "Mozilla/5.0", 0},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		r.Header.Set("User-Agent", tt.userAgent)
+		w := httptest.NewRecorder()
+		next := &nextHandler{}
+		err := gsrv.ServeHTTP(w, r, next)
+
+		status := w.Code
+		if he, ok := err.(caddyhttp.HandlerError); ok {
+			status = he.StatusCode
+		}
+		if tt.status == 0 {
+			if !next.called {
+				t.Errorf("%s: not passed on to the next handler, got %d", tt.path, status)
+			}
+		} else if next.called || status != tt.status {
+			t.Errorf("%s: got %d (next handler called: %v), want %d", tt.path, status, next.called, tt.status)
+		}
+	}
+}
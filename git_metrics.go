@@ -0,0 +1,117 @@
+package gitserver
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are registered with the default registry, which Caddy exposes on its metrics endpoint
+var gitMetrics = struct {
+	init            sync.Once
+	cloneAttempts   *prometheus.CounterVec
+	requests        *prometheus.CounterVec
+	bytesServed     *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+}{
+	init: sync.Once{},
+}
+
+func initGitMetrics() {
+	const ns, sub = "caddy", "git_server"
+
+	gitMetrics.cloneAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "clone_attempts_total",
+		Help:      "Number of info/refs requests made by git clients.",
+	}, []string{"repo"})
+
+	labels := []string{"repo", "page"}
+	gitMetrics.requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "requests_total",
+		Help:      "Number of requests handled for a repository, by page. Git client requests use the page 'git'.",
+	}, labels)
+	gitMetrics.bytesServed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "response_bytes_total",
+		Help:      "Number of response body bytes written for a repository, by page.",
+	}, labels)
+	gitMetrics.requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "request_duration_seconds",
+		Help:      "Histogram of request durations for a repository, by page.",
+		Buckets:   prometheus.DefBuckets,
+	}, labels)
+}
+
+// emitMetrics records a handled request for the repository named repo
+func emitMetrics(repo string, page string, start time.Time, written int64) {
+	// Pages come from the url, so unknown ones are grouped to keep the number of series bounded
+	if _, ok := template_pages[page]; !ok && page != "git" && page != "feed.atom" {
+		page = "other"
+	}
+
+	gitMetrics.requests.WithLabelValues(repo, page).Inc()
+	gitMetrics.bytesServed.WithLabelValues(repo, page).Add(float64(written))
+	gitMetrics.requestDuration.WithLabelValues(repo, page).Observe(time.Since(start).Seconds())
+}
+
+// metricsWriter counts the bytes written to the response body and remembers the status code
+type metricsWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	written int64
+	status  int
+}
+
+func newMetricsWriter(w http.ResponseWriter) *metricsWriter {
+	return &metricsWriter{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}}
+}
+
+func (mw *metricsWriter) WriteHeader(status int) {
+	if mw.status == 0 {
+		mw.status = status
+	}
+	mw.ResponseWriterWrapper.WriteHeader(status)
+}
+
+// statusCode returns the status of the response, err is the error the handler returned
+func (mw *metricsWriter) statusCode(err error) int {
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(err, &handlerErr) {
+		return handlerErr.StatusCode
+	}
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	if mw.status == 0 {
+		return http.StatusOK
+	}
+	return mw.status
+}
+
+func (mw *metricsWriter) Write(b []byte) (int, error) {
+	n, err := mw.ResponseWriterWrapper.Write(b)
+	mw.written += int64(n)
+	return n, err
+}
+
+// ReadFrom is used by the file server to copy files, so it has to be counted too
+func (mw *metricsWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := mw.ResponseWriterWrapper.ReadFrom(r)
+	mw.written += n
+	return n, err
+}
+
+// Interface guards
+var _ caddyhttp.HTTPInterfaces = (*metricsWriter)(nil)
@@ -0,0 +1,212 @@
+package gitserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"go.uber.org/zap"
+)
+
+const (
+	// Default time between fetches of a mirror
+	defaultMirrorInterval = time.Hour
+	// A clone or fetch of a mirror is abandoned after this long
+	mirrorTimeout = 10 * time.Minute
+)
+
+// Branches and tags of the upstream are copied as they are, like 'git clone --mirror' without the other refs
+var mirrorRefSpecs = []config.RefSpec{
+	"+refs/heads/*:refs/heads/*",
+	"+refs/tags/*:refs/tags/*",
+}
+
+// MirrorConfig is an upstream repository that is kept in sync in the root
+type MirrorConfig struct {
+	// Url of the upstream repository
+	URL string `json:"url"`
+
+	// Time between fetches from the upstream (default 1h)
+	Interval caddy.Duration `json:"interval,omitempty"`
+}
+
+// mirrorName returns the name a mirror is served as: the path of the upstream url without the suffix,
+// e.g. 'https://github.com/Rex--/caddy-git-server.git' is served as 'Rex--/caddy-git-server'
+func mirrorName(upstream, suffix string) (string, error) {
+	endpoint, err := transport.NewEndpoint(upstream)
+	if err != nil {
+		return "", err
+	}
+	name := strings.Trim(endpoint.Path, "/")
+	name = strings.TrimSuffix(name, suffix)
+	name = strings.TrimSuffix(name, ".git")
+	if name == "" || strings.Contains(name, "..") {
+		return "", fmt.Errorf("no repository name in mirror url '%s'", upstream)
+	}
+	return name, nil
+}
+
+// startMirrors clones the mirrors into the root and fetches them every interval until Cleanup is called.
+// A root with placeholders is only known at request time, so it can't hold mirrors.
+func (gsrv *GitServer) startMirrors() {
+	if len(gsrv.Mirrors) == 0 {
+		return
+	}
+	if strings.Contains(gsrv.Root, "{") {
+		gsrv.logger.Warn("mirrors are not synced into a root with placeholders", zap.String("root", gsrv.Root))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	gsrv.mirrorCancel = cancel
+	for _, mirror := range gsrv.Mirrors {
+		interval := time.Duration(mirror.Interval)
+		if interval <= 0 {
+			interval = defaultMirrorInterval
+		}
+		go func(mirror MirrorConfig, interval time.Duration) {
+			gsrv.syncMirror(ctx, mirror)
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					gsrv.syncMirror(ctx, mirror)
+				case <-ctx.Done():
+					gsrv.logger.Debug("stopped mirror", zap.String("url", mirror.URL))
+					return
+				}
+			}
+		}(mirror, interval)
+	}
+}
+
+// stopMirrors stops syncing the mirrors and abandons fetches in progress
+func (gsrv *GitServer) stopMirrors() {
+	if gsrv.mirrorCancel != nil {
+		gsrv.mirrorCancel()
+	}
+}
+
+// syncMirror creates the mirror in the root if it doesn't exist yet and fetches the upstream into it.
+// Branches and tags that were deleted upstream are deleted from the mirror.
+func (gsrv *GitServer) syncMirror(ctx context.Context, mirror MirrorConfig) {
+	name, err := mirrorName(mirror.URL, gsrv.RepoSuffix)
+	if err != nil {
+		gsrv.logger.Error("invalid mirror", zap.String("url", mirror.URL), zap.Error(err))
+		return
+	}
+	repoPath := filepath.Join(gsrv.Root, filepath.FromSlash(name)+gsrv.RepoSuffix)
+
+	ctx, cancel := context.WithTimeout(ctx, mirrorTimeout)
+	defer cancel()
+
+	start := time.Now()
+	created, err := gsrv.fetchMirror(ctx, repoPath, mirror.URL)
+	if err != nil {
+		gsrv.logger.Error("could not sync mirror",
+			zap.String("url", mirror.URL),
+			zap.String("git_repo", repoPath),
+			zap.Error(err),
+		)
+		return
+	}
+	gsrv.logger.Info("synced mirror",
+		zap.String("url", mirror.URL),
+		zap.String("git_repo", repoPath),
+		zap.Duration("duration", time.Since(start)),
+	)
+
+	// The new repository can be deep in the root, where the scanner wouldn't notice it
+	if created {
+		gsrv.rescanRepositories()
+	}
+}
+
+// fetchMirror fetches the upstream into the bare repository at repoPath, creating it first if it doesn't exist.
+// It returns true if the repository was created.
+func (gsrv *GitServer) fetchMirror(ctx context.Context, repoPath, upstream string) (bool, error) {
+	created := false
+	repo, err := git.PlainOpen(repoPath)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		if err := os.MkdirAll(repoPath, 0755); err != nil {
+			return false, err
+		}
+		repo, err = git.PlainInit(repoPath, true)
+		if err != nil {
+			return false, err
+		}
+		_, err = repo.CreateRemote(&config.RemoteConfig{
+			Name:  git.DefaultRemoteName,
+			URLs:  []string{upstream},
+			Fetch: mirrorRefSpecs,
+		})
+		created = true
+	}
+	if err != nil {
+		return created, err
+	}
+
+	remote, err := repo.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return created, err
+	}
+	err = remote.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs: mirrorRefSpecs,
+		Tags:     git.NoTags,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return created, err
+	}
+
+	return created, pruneMirror(ctx, repo, remote)
+}
+
+// pruneMirror deletes the branches and tags that no longer exist upstream
+// and points HEAD at the default branch of the upstream
+func pruneMirror(ctx context.Context, repo *git.Repository, remote *git.Remote) error {
+	upstreamRefs, err := remote.ListContext(ctx, &git.ListOptions{})
+	if err != nil {
+		return err
+	}
+	upstream := make(map[plumbing.ReferenceName]bool, len(upstreamRefs))
+	for _, ref := range upstreamRefs {
+		upstream[ref.Name()] = true
+		if ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference {
+			err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, ref.Target()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	refs, err := repo.References()
+	if err != nil {
+		return err
+	}
+	var deleted []plumbing.ReferenceName
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if (ref.Name().IsBranch() || ref.Name().IsTag()) && !upstream[ref.Name()] {
+			deleted = append(deleted, ref.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range deleted {
+		if err := repo.Storer.RemoveReference(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
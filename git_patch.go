@@ -0,0 +1,111 @@
+package gitserver
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// servePatch writes a commit as a mailbox patch like 'git format-patch', so it can be applied with 'git am'
+func (gsrv *GitServer) servePatch(repo *git.Repository, rev string, w http.ResponseWriter, r *http.Request) error {
+	hash, err := gsrv.resolveRevision(repo, rev)
+	if err != nil {
+		return caddyhttp.Error(revisionStatus(err), err)
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+
+	// The patch of a commit never changes, a ref or short hash can point somewhere else later
+	etag := "\"" + commit.Hash.String() + ".patch\""
+	w.Header().Set("ETag", etag)
+	if len(rev) == 40 && isHex(rev) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(rawRefMaxAge))
+	}
+	if notModified(r, etag, time.Time{}) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	patch, err := getCommitPatch(commit)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	body, err := formatPatch(commit, patch)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// formatPatch builds the mailbox message for a commit: the headers, the commit message,
+// a diffstat, and the diff against the first parent
+func formatPatch(commit *object.Commit, patch *object.Patch) ([]byte, error) {
+	subject, body := splitCommitMessage(commit.Message)
+
+	var buf bytes.Buffer
+	// The date on the From line is fixed, git uses it to recognise its own patches
+	fmt.Fprintf(&buf, "From %s Mon Sep 17 00:00:00 2001\n", commit.Hash)
+	fmt.Fprintf(&buf, "From: %s <%s>\n", mime.QEncoding.Encode("utf-8", commit.Author.Name), commit.Author.Email)
+	fmt.Fprintf(&buf, "Date: %s\n", commit.Author.When.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Subject: [PATCH] %s\n", mime.QEncoding.Encode("utf-8", subject))
+	buf.WriteString("MIME-Version: 1.0\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\n\n")
+	if body != "" {
+		buf.WriteString(body + "\n")
+	}
+
+	buf.WriteString("---\n")
+	stats := patch.Stats()
+	buf.WriteString(stats.String())
+	buf.WriteString(diffStatSummary(stats) + "\n\n")
+
+	if err := patch.Encode(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// diffStatSummary returns the last line of a diffstat, e.g. ' 2 files changed, 3 insertions(+), 1 deletion(-)'
+func diffStatSummary(stats object.FileStats) string {
+	additions, deletions := 0, 0
+	for _, s := range stats {
+		additions += s.Addition
+		deletions += s.Deletion
+	}
+
+	summary := fmt.Sprintf(" %d %s changed", len(stats), plural(len(stats), "file", "files"))
+	if additions > 0 {
+		summary += fmt.Sprintf(", %d %s(+)", additions, plural(additions, "insertion", "insertions"))
+	}
+	if deletions > 0 {
+		summary += fmt.Sprintf(", %d %s(-)", deletions, plural(deletions, "deletion", "deletions"))
+	}
+	return summary
+}
+
+func plural(n int, one string, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
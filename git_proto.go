@@ -1,10 +1,22 @@
 package gitserver
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/fs"
 	"net/http"
+	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/go-git/go-git/v5"
@@ -12,9 +24,52 @@ import (
 	"go.uber.org/zap"
 )
 
+// Loose objects are stored as objects/<first two hex digits>/<remaining hex digits>
+var looseObjectPath = regexp.MustCompile(`objects/[0-9a-f]{2}/[0-9a-f]{38}$`)
+
+// Seconds a client is told to wait when every clone slot is taken
+const cloneRetryAfter = 5
+
 // Serve a git client
 func (gs *GitServer) serveGitClient(repoPath string, w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 
+	// Every clone starts by fetching the refs, so that is what gets rate limited
+	if gs.cloneLimiter != nil && strings.HasSuffix(r.URL.Path, "info/refs") {
+		ip := gs.clientIP(r)
+		if ok, wait := gs.cloneLimiter.allow(ip, time.Now()); !ok {
+			gs.logger.Info("clone rate limit exceeded",
+				zap.String("client_ip", ip),
+				zap.String("git_repo", repoPath),
+			)
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			return caddyhttp.Error(http.StatusTooManyRequests, fmt.Errorf("clone rate limit exceeded"))
+		}
+	}
+
+	// Requests over the concurrency limit are turned away instead of queued, so they can't pile up
+	if gs.cloneSlots != nil {
+		select {
+		case gs.cloneSlots <- struct{}{}:
+			defer func() { <-gs.cloneSlots }()
+		default:
+			gs.logger.Info("too many concurrent clones",
+				zap.String("client_ip", gs.clientIP(r)),
+				zap.String("git_repo", repoPath),
+			)
+			w.Header().Set("Retry-After", strconv.Itoa(cloneRetryAfter))
+			return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("too many concurrent clones"))
+		}
+	}
+
+	// Packs may be replaced while a repository is repacked, clients have to come back afterwards
+	if gs.activity != nil {
+		if !gs.activity.begin(repoPath) {
+			w.Header().Set("Retry-After", strconv.Itoa(cloneRetryAfter))
+			return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("repository is being repacked"))
+		}
+		defer gs.activity.end(repoPath)
+	}
+
 	// Only dumb protocol is implemented at the moment
 	return gs.serveGitDumb(repoPath, w, r, next)
 }
@@ -41,33 +96,50 @@ func (gs *GitServer) serveGitDumb(repoPath string, w http.ResponseWriter, r *htt
 			zap.String("git_protocol", r.Header.Get("Git-Protocol")),
 			zap.String("git_client", r.UserAgent()),
 		)
+		gitMetrics.cloneAttempts.WithLabelValues(gs.repoName(repoPath, r)).Inc()
 
-		var refs []string
-
-		// Collect all heads in repo
+		// Collect all heads and tags in repo, go-git reads both loose and packed refs
+		var repoRefs []*plumbing.Reference
 		repoHeads, err := repo.Branches()
 		if err != nil {
 			return caddyhttp.Error(http.StatusInternalServerError, err)
 		}
-		// Write heads to connection
 		repoHeads.ForEach(func(r *plumbing.Reference) error {
-			fmt.Fprintf(w, "%s\t%s\n", r.Hash().String(), r.Name().String())
-			refs = append(refs, r.String())
+			if !gs.isHiddenRef(r.Name()) {
+				repoRefs = append(repoRefs, r)
+			}
 			return nil
 		})
-
-		// Collect all tags in repo
 		repoTags, err := repo.Tags()
 		if err != nil {
 			return caddyhttp.Error(http.StatusInternalServerError, err)
 		}
-		// Write tags to connection
 		repoTags.ForEach(func(r *plumbing.Reference) error {
-			fmt.Fprintf(w, "%s\t%s\n", r.Hash().String(), r.Name().String())
-			refs = append(refs, r.String())
+			if !gs.isHiddenRef(r.Name()) {
+				repoRefs = append(repoRefs, r)
+			}
 			return nil
 		})
 
+		// Loose refs come before packed ones, sort them by name like git update-server-info does
+		sort.Slice(repoRefs, func(i, j int) bool {
+			return repoRefs[i].Name() < repoRefs[j].Name()
+		})
+
+		// Write refs to the response. Annotated tags are followed by the object they
+		// point at, peeled like 'refs/tags/<name>^{}', the same as git update-server-info.
+		var refs []string
+		var out bytes.Buffer
+		for _, ref := range repoRefs {
+			fmt.Fprintf(&out, "%s\t%s\n", ref.Hash().String(), ref.Name().String())
+			if ref.Name().IsTag() {
+				if target, annotated := peelTag(repo, ref.Hash()); annotated {
+					fmt.Fprintf(&out, "%s\t%s^{}\n", target.String(), ref.Name().String())
+				}
+			}
+			refs = append(refs, ref.String())
+		}
+
 		gs.logger.Debug("generating dumb info/refs",
 			zap.String("git_repo", repoPath),
 			zap.String("req_path", r.URL.Path),
@@ -98,7 +170,11 @@ func (gs *GitServer) serveGitDumb(repoPath string, w http.ResponseWriter, r *htt
 		// // Write info/refs to connection and close it
 		// fmt.Fprintf(w, "%s", infoRefs)
 		//                                             //
-		return nil
+
+		// The refs are all that changes in info/refs, so polling clients can skip unchanged refs
+		sum := sha1.Sum(out.Bytes())
+		etag := "\"" + hex.EncodeToString(sum[:]) + "\""
+		return writeDumbResponse(w, r, out.Bytes(), etag)
 	}
 
 	// Detect 'objects/info/packs' and generate and serve
@@ -116,14 +192,224 @@ func (gs *GitServer) serveGitDumb(repoPath string, w http.ResponseWriter, r *htt
 			return caddyhttp.Error(http.StatusInternalServerError, err)
 		}
 
+		// List the newest packs first, git prefers them when fetching over the dumb protocol
+		packTimes := make(map[string]time.Time, len(packFiles))
+		for _, packFile := range packFiles {
+			if info, err := os.Stat(packFile); err == nil {
+				packTimes[packFile] = info.ModTime()
+			}
+		}
+		sort.SliceStable(packFiles, func(i, j int) bool {
+			return packTimes[packFiles[i]].After(packTimes[packFiles[j]])
+		})
+
 		// Write pack file response
+		var out bytes.Buffer
 		for _, packFile := range packFiles {
-			fmt.Fprintf(w, "P %s\n", filepath.Base(packFile))
+			fmt.Fprintf(&out, "P %s\n", filepath.Base(packFile))
+		}
+
+		return writeDumbResponse(w, r, out.Bytes(), "")
+	}
+
+	// Detect 'objects/info/http-alternates' and 'objects/info/alternates' and generate them from the alternates file.
+	// Alternates are filesystem paths, dumb clients need them translated into urls on this server.
+	if strings.HasSuffix(r.URL.Path, "objects/info/http-alternates") || strings.HasSuffix(r.URL.Path, "objects/info/alternates") {
+		root, err := gs.requestRoot(r)
+		if err != nil {
+			return err
+		}
+		alternates, unresolved, err := gs.httpAlternates(repoPath, root)
+		if errors.Is(err, fs.ErrNotExist) {
+			return caddyhttp.Error(http.StatusNotFound, err)
+		}
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+
+		// Object stores outside the root can't be served, let the client know they were left out
+		if unresolved > 0 {
+			gs.logger.Warn("alternate object stores outside the root are not served",
+				zap.String("git_repo", repoPath),
+				zap.Int("unresolved", unresolved),
+			)
+			w.Header().Set("Warning", fmt.Sprintf("199 - \"%d alternate object stores outside the root were omitted\"", unresolved))
+		}
+		if len(alternates) == 0 {
+			return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("no alternates can be served"))
+		}
+
+		var out bytes.Buffer
+		for _, alternate := range alternates {
+			fmt.Fprintf(&out, "%s\n", alternate)
 		}
 
+		return writeDumbResponse(w, r, out.Bytes(), "")
+	}
+
+	// Only files git needs for a fetch are served, the config and hooks can hold secrets
+	repoFile := gs.repoFilePath(repoPath, r)
+	if !isDumbTransferPath(repoFile) {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("not a git transfer path: %s", repoFile))
+	}
+	if strings.HasPrefix(repoFile, "refs/") && gs.isHiddenRef(plumbing.ReferenceName(repoFile)) {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("hidden ref: %s", repoFile))
+	}
+
+	// Only regular files are served. A loose object request for an object that is packed must be
+	// a clean 404, so the client falls back to the packs, and directories must never be listed.
+	diskFile := filepath.Join(repoPath, filepath.FromSlash(repoFile))
+	if info, err := os.Stat(diskFile); err != nil || !info.Mode().IsRegular() {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("no such file in repository: %s", repoFile))
+	}
+
+	// Static repository files are served with the types git http-backend uses. Packs are served
+	// by the file server, which supports range requests so interrupted clones can resume.
+	w.Header().Set("Content-Type", dumbContentType(r.URL.Path))
+	if strings.HasSuffix(r.URL.Path, ".pack") {
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+
+	// Repositories registered with an explicit path or found in the other roots are outside the root
+	// the file server uses, and repositories stored without the suffix aren't at the path of the request
+	_, explicit := gs.explicitRepoName(repoPath)
+	_, inExtraRoot := gs.extraRootOf(repoPath)
+	if explicit || inExtraRoot || !strings.HasSuffix(repoPath, gs.RepoSuffix) {
+		http.ServeFile(w, r, diskFile)
 		return nil
 	}
 
-	// Serve the file if it exists
+	// Serve the file if it exists, relative to the root without the ignored prefix
+	if gs.IgnorePrefix != "" {
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = gs.stripIgnorePrefix(r.URL.Path)
+		r = r2
+	}
 	return gs.FileServer.ServeHTTP(w, r, next)
 }
+
+// repoFilePath returns the path of the requested file inside the repository at repoPath, without a leading slash
+func (gs *GitServer) repoFilePath(repoPath string, r *http.Request) string {
+	rest := strings.TrimPrefix(strings.TrimPrefix(gs.stripIgnorePrefix(r.URL.Path), "/"), gs.repoName(repoPath, r))
+	rest = strings.TrimPrefix(rest, gs.RepoSuffix)
+	return strings.TrimPrefix(path.Clean("/"+rest), "/")
+}
+
+// isDumbTransferPath reports whether a file in a repository is one that dumb protocol clients fetch
+func isDumbTransferPath(repoFile string) bool {
+	return repoFile == "HEAD" ||
+		strings.HasPrefix(repoFile, "objects/") ||
+		strings.HasPrefix(repoFile, "refs/") ||
+		strings.HasPrefix(repoFile, "info/")
+}
+
+// writeDumbResponse writes a generated dumb protocol file. The body is compressed if the
+// client supports it, and HEAD requests only get the headers a GET would have returned.
+// Uncompressed responses support range requests. etag is the ETag of the uncompressed body,
+// empty for none, the compressed body gets its own so the two are never mixed up.
+func writeDumbResponse(w http.ResponseWriter, r *http.Request, body []byte, etag string) error {
+	// Generated dumb files are plain text, same as git http-backend serves them
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	// Ranges refer to the uncompressed body, so range requests are served as is
+	compress := acceptsGzip(r) && r.Header.Get("Range") == ""
+	if etag != "" {
+		if compress {
+			etag = strings.TrimSuffix(etag, "\"") + "-gzip\""
+		}
+		w.Header().Set("ETag", etag)
+		if notModified(r, etag, time.Time{}) {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+
+	if !compress {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+		return nil
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(body); err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	if err := gz.Close(); err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	body = buf.Bytes()
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// dumbContentType returns the content type of a static file requested by a dumb client
+func dumbContentType(urlPath string) string {
+	dir, name := path.Split(urlPath)
+	switch {
+	case strings.HasSuffix(dir, "objects/pack/") && strings.HasSuffix(name, ".pack"):
+		return "application/x-git-packed-objects"
+	case strings.HasSuffix(dir, "objects/pack/") && strings.HasSuffix(name, ".idx"):
+		return "application/x-git-packed-objects-toc"
+	case looseObjectPath.MatchString(urlPath):
+		return "application/x-git-loose-object"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// httpAlternates reads the alternates file of the repository at repoPath and translates each
+// object store into an absolute url path on this server. Object stores outside of root have
+// no url, they are counted as unresolved.
+func (gs *GitServer) httpAlternates(repoPath string, root string) ([]string, int, error) {
+	objectsDir := filepath.Join(repoPath, "objects")
+	data, err := os.ReadFile(filepath.Join(objectsDir, "info", "alternates"))
+	if err != nil {
+		return nil, 0, err
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var alternates []string
+	unresolved := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Relative alternates are relative to the objects directory
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(objectsDir, line)
+		}
+		alternate, err := filepath.Abs(line)
+		if err != nil {
+			unresolved++
+			continue
+		}
+
+		rel, err := filepath.Rel(absRoot, alternate)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			unresolved++
+			continue
+		}
+
+		// Urls keep the ignored prefix, same as the clone url
+		urlPath := filepath.ToSlash(rel)
+		if prefix := strings.Trim(gs.IgnorePrefix, "/"); prefix != "" {
+			urlPath = prefix + "/" + urlPath
+		}
+		alternates = append(alternates, "/"+urlPath)
+	}
+
+	return alternates, unresolved, nil
+}
@@ -0,0 +1,111 @@
+package gitserver
+
+import (
+	"container/list"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum number of client buckets kept, the least recently used one is evicted first
+const cloneLimiterMaxClients = 10000
+
+// cloneLimiter is a token bucket per client IP. Each bucket holds up to limit
+// tokens and is refilled at a rate of limit tokens per window.
+type cloneLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*list.Element
+	lru     *list.List
+}
+
+type cloneBucket struct {
+	ip      string
+	tokens  float64
+	updated time.Time
+}
+
+func newCloneLimiter(limit int, window time.Duration) *cloneLimiter {
+	return &cloneLimiter{
+		limit:   limit,
+		window:  window,
+		clients: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// clear forgets every client, so their buckets can be freed
+func (cl *cloneLimiter) clear() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.clients = make(map[string]*list.Element)
+	cl.lru.Init()
+}
+
+// allow takes a token from the bucket of ip. It returns false if the bucket is empty,
+// along with how long until the next token is available.
+func (cl *cloneLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	var bucket *cloneBucket
+	if elem, ok := cl.clients[ip]; ok {
+		cl.lru.MoveToFront(elem)
+		bucket = elem.Value.(*cloneBucket)
+
+		// Refill the tokens earned since the bucket was last used
+		rate := float64(cl.limit) / cl.window.Seconds()
+		bucket.tokens += now.Sub(bucket.updated).Seconds() * rate
+		if bucket.tokens > float64(cl.limit) {
+			bucket.tokens = float64(cl.limit)
+		}
+		bucket.updated = now
+	} else {
+		bucket = &cloneBucket{ip: ip, tokens: float64(cl.limit), updated: now}
+		cl.clients[ip] = cl.lru.PushFront(bucket)
+		if cl.lru.Len() > cloneLimiterMaxClients {
+			oldest := cl.lru.Back()
+			cl.lru.Remove(oldest)
+			delete(cl.clients, oldest.Value.(*cloneBucket).ip)
+		}
+	}
+
+	if bucket.tokens < 1 {
+		rate := float64(cl.limit) / cl.window.Seconds()
+		wait := time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// clientIP returns the IP address of the client that made the request. If the request came
+// from a trusted proxy, X-Forwarded-For is read from the right, each proxy appends the address
+// it got the request from, and the first address that isn't a trusted proxy is the client.
+// Anything to the left of it was sent by the client and can't be trusted.
+func (gsrv *GitServer) clientIP(r *http.Request) string {
+	if gsrv.isTrustedProxy(r) {
+		var fwdFor []string
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			fwdFor = append(fwdFor, strings.Split(value, ",")...)
+		}
+		for i := len(fwdFor) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(fwdFor[i])
+			if ip == "" {
+				continue
+			}
+			if i == 0 || !gsrv.isTrustedAddr(ip) {
+				return ip
+			}
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return strings.SplitN(ip, "%", 2)[0]
+}
@@ -0,0 +1,90 @@
+package gitserver
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/go-git/go-git/v5"
+)
+
+// Seconds a raw file requested by a branch or tag name may be cached, the ref can move at any time
+const rawRefMaxAge = 60
+
+// serveRaw writes the contents of a file for a '<ref>/<path>' argument string.
+// Files are displayed inline unless the 'download' query parameter is set.
+func (gsrv *GitServer) serveRaw(repo *git.Repository, pageArgs string, w http.ResponseWriter, r *http.Request) error {
+	refStr, filePath, err := splitRefPath(pageArgs)
+	if err != nil {
+		return err
+	}
+
+	hash, err := gsrv.resolveRevision(repo, refStr)
+	if err != nil {
+		return caddyhttp.Error(revisionStatus(err), err)
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+	file, err := commit.File(filePath)
+	if err != nil {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+
+	// A blob never changes, so its hash is all the validation a client needs
+	etag := "\"" + file.Hash.String() + "\""
+	w.Header().Set("ETag", etag)
+
+	// A file requested by a full commit hash can never change, anything else is only cached briefly
+	if len(refStr) == 40 && isHex(refStr) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(rawRefMaxAge))
+	}
+	if notModified(r, etag, time.Time{}) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	reader, err := file.Reader()
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	defer reader.Close()
+
+	// Text is always shown as plain text, so files from the repository can't run scripts in the browser
+	content := bufio.NewReaderSize(reader, binaryCheckSize)
+	head, _ := content.Peek(binaryCheckSize)
+	contentType := "text/plain; charset=utf-8"
+	if imageType := imageContentType(filePath, head); imageType != "" {
+		// Images are shown by the blob page. An svg opened directly could still run scripts, so it is sandboxed.
+		contentType = imageType
+		if imageType == "image/svg+xml" {
+			w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+		}
+	} else if isBinary(head) {
+		contentType = "application/octet-stream"
+	}
+
+	disposition := "inline"
+	if download := r.URL.Query().Get("download"); download != "" && download != "0" {
+		disposition = "attachment"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": path.Base(filePath)}))
+	w.Header().Set("Content-Length", strconv.FormatInt(file.Size, 10))
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	_, err = io.Copy(w, content)
+	return err
+}
@@ -0,0 +1,56 @@
+package gitserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/go-git/go-git/v5"
+)
+
+type refsResponse struct {
+	Branches []refsBranch `json:"branches"`
+	Tags     []refsTag    `json:"tags"`
+}
+
+type refsBranch struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+}
+
+type refsTag struct {
+	Name string `json:"name"`
+	// Hash of the tag object for annotated tags, otherwise the commit
+	Hash string `json:"hash"`
+	// Commit the tag points at
+	Target string `json:"target"`
+}
+
+// serveRefs writes the branches and tags of a repository as json, for tooling that polls the refs
+func (gsrv *GitServer) serveRefs(repo *git.Repository, w http.ResponseWriter, r *http.Request) error {
+	branches, tags, err := gsrv.collectRefs(repo)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	// Empty lists are written as [] rather than null
+	refs := refsResponse{
+		Branches: make([]refsBranch, 0, len(branches)),
+		Tags:     make([]refsTag, 0, len(tags)),
+	}
+	for _, b := range branches {
+		refs.Branches = append(refs.Branches, refsBranch{Name: b.Name, Hash: b.Hash})
+	}
+	for _, t := range tags {
+		refs.Tags = append(refs.Tags, refsTag{Name: t.Name, Hash: t.Hash, Target: t.Commit})
+	}
+
+	body, err := json.Marshal(refs)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, err = w.Write(body)
+	return err
+}
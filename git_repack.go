@@ -0,0 +1,179 @@
+package gitserver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	// Repositories with fewer loose objects than this aren't repacked
+	repackMinLooseObjects = 50
+	// A repository is only repacked when no git client has fetched from it for this long.
+	// A dumb clone is many requests, the packs a client listed must stay until it is done.
+	repackIdleTime = time.Minute
+	// Superseded packs younger than this are kept, a push may still be updating its refs
+	repackKeepPacks = time.Hour
+)
+
+// repoActivity tracks the git client requests per repository, so a repository
+// is never repacked while a client may be fetching the packs it replaces
+type repoActivity struct {
+	mu        sync.Mutex
+	inflight  map[string]int
+	lastSeen  map[string]time.Time
+	repacking map[string]bool
+}
+
+func newRepoActivity() *repoActivity {
+	return &repoActivity{
+		inflight:  make(map[string]int),
+		lastSeen:  make(map[string]time.Time),
+		repacking: make(map[string]bool),
+	}
+}
+
+// begin records a git client request for repoPath. It returns false if the repository is being repacked.
+func (ra *repoActivity) begin(repoPath string) bool {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.repacking[repoPath] {
+		return false
+	}
+	ra.inflight[repoPath]++
+	ra.lastSeen[repoPath] = time.Now()
+	return true
+}
+
+// end records that a git client request for repoPath is done
+func (ra *repoActivity) end(repoPath string) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.inflight[repoPath]--
+	if ra.inflight[repoPath] <= 0 {
+		delete(ra.inflight, repoPath)
+	}
+	ra.lastSeen[repoPath] = time.Now()
+}
+
+// beginRepack marks repoPath as being repacked. It returns false if a client fetched from it recently.
+func (ra *repoActivity) beginRepack(repoPath string) bool {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.inflight[repoPath] > 0 || time.Since(ra.lastSeen[repoPath]) < repackIdleTime {
+		return false
+	}
+	ra.repacking[repoPath] = true
+	return true
+}
+
+// endRepack lets git clients fetch from repoPath again
+func (ra *repoActivity) endRepack(repoPath string) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	delete(ra.repacking, repoPath)
+}
+
+// startRepacker repacks the repositories in the root every AutoMaintenance until Cleanup is called.
+// A root with placeholders is only known at request time, so it is never repacked.
+func (gsrv *GitServer) startRepacker() {
+	if gsrv.AutoMaintenance <= 0 || strings.Contains(gsrv.Root, "{") {
+		return
+	}
+
+	gsrv.repackStop = make(chan struct{})
+	go func(stop <-chan struct{}) {
+		ticker := time.NewTicker(time.Duration(gsrv.AutoMaintenance))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				gsrv.repackRepositories(stop)
+			case <-stop:
+				gsrv.logger.Debug("stopped repository maintenance", zap.String("root", gsrv.Root))
+				return
+			}
+		}
+	}(gsrv.repackStop)
+}
+
+// stopRepacker stops the background maintenance, if it was started
+func (gsrv *GitServer) stopRepacker() {
+	if gsrv.repackStop != nil {
+		close(gsrv.repackStop)
+	}
+}
+
+// repackRepositories packs the loose objects of every repository that has enough of them.
+// Repositories that are being fetched from are skipped until the next run.
+func (gsrv *GitServer) repackRepositories(stop <-chan struct{}) {
+	for _, name := range gsrv.repositoryNames() {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		repoPath := gsrv.resolveRepoPath(gsrv.Root, name)
+		loose := looseObjectCount(repoPath)
+		if loose < repackMinLooseObjects {
+			continue
+		}
+		if !gsrv.activity.beginRepack(repoPath) {
+			gsrv.logger.Debug("skipping repack of repository in use", zap.String("git_repo", repoPath))
+			continue
+		}
+
+		start := time.Now()
+		err := repackRepository(repoPath)
+		gsrv.activity.endRepack(repoPath)
+		if err != nil {
+			gsrv.logger.Error("could not repack repository",
+				zap.String("git_repo", repoPath),
+				zap.Error(err),
+			)
+			continue
+		}
+		gsrv.logger.Info("repacked repository",
+			zap.String("git_repo", repoPath),
+			zap.Int("loose_objects", loose),
+			zap.Duration("duration", time.Since(start)),
+		)
+	}
+}
+
+// repackRepository packs every object reachable from a ref into a single pack and deletes the loose copies.
+// Packs it replaces are only deleted once they are older than repackKeepPacks.
+func repackRepository(repoPath string) error {
+	repo, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return err
+	}
+	return repo.RepackObjects(&git.RepackConfig{
+		OnlyDeletePacksOlderThan: time.Now().Add(-repackKeepPacks),
+	})
+}
+
+// looseObjectCount returns the number of loose objects in the repository at repoPath
+func looseObjectCount(repoPath string) int {
+	dirs, err := os.ReadDir(filepath.Join(repoPath, "objects"))
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 || !isHex(dir.Name()) {
+			continue
+		}
+		objects, err := os.ReadDir(filepath.Join(repoPath, "objects", dir.Name()))
+		if err == nil {
+			count += len(objects)
+		}
+	}
+	return count
+}
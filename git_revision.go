@@ -0,0 +1,158 @@
+package gitserver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// Shortest abbreviated commit hash that is looked up, like git's core.abbrev minimum
+const minShortHashLength = 4
+
+// revisionError is returned for a revision that can't be resolved.
+// Its message only holds the revision and candidate hashes, so it is safe to show to clients.
+type revisionError struct {
+	rev string
+	// Abbreviated hashes of the commits an ambiguous short hash matches
+	candidates []string
+	err        error
+}
+
+func (e *revisionError) Error() string {
+	if len(e.candidates) > 0 {
+		return fmt.Sprintf("revision '%s' is ambiguous, it matches %s", e.rev, strings.Join(e.candidates, ", "))
+	}
+	return fmt.Sprintf("revision '%s' not found", e.rev)
+}
+
+func (e *revisionError) Unwrap() error {
+	return e.err
+}
+
+// revisionStatus returns the status for an error of resolveRevision when the revision is part of the url path:
+// 400 for an ambiguous short hash, 404 otherwise
+func revisionStatus(err error) int {
+	var revErr *revisionError
+	if errors.As(err, &revErr) && len(revErr.candidates) > 0 {
+		return http.StatusBadRequest
+	}
+	return http.StatusNotFound
+}
+
+// resolveRevision resolves a revision like repo.ResolveRevision, but a revision starting
+// at a hidden ref isn't found and a short hash matching several commits is an error
+// instead of resolving to one of them.
+func (gsrv *GitServer) resolveRevision(repo *git.Repository, rev string) (*plumbing.Hash, error) {
+	refPart, suffix := rev, ""
+	if i := strings.IndexAny(rev, "~^@:"); i >= 0 {
+		refPart, suffix = rev[:i], rev[i:]
+	}
+
+	if len(gsrv.HideRefs) > 0 && gsrv.isHiddenRevision(repo, refPart) {
+		return nil, &revisionError{rev: rev, err: plumbing.ErrReferenceNotFound}
+	}
+
+	// Refs named like a hash win over the hash, go-git prefers the hash but checks neither for ambiguity
+	if isHex(refPart) && len(refPart) < len(plumbing.ZeroHash)*2 && !refExists(repo, refPart) {
+		if len(refPart) < minShortHashLength {
+			return nil, &revisionError{rev: rev, err: plumbing.ErrReferenceNotFound}
+		}
+		candidates := commitsWithPrefix(repo, refPart)
+		switch len(candidates) {
+		case 0:
+			return nil, &revisionError{rev: rev, err: plumbing.ErrReferenceNotFound}
+		case 1:
+			rev = candidates[0].String() + suffix
+		default:
+			// Abbreviated a few digits past the prefix, so the candidates can be told apart
+			abbrev := len(refPart) + 3
+			if abbrev > len(plumbing.ZeroHash)*2 {
+				abbrev = len(plumbing.ZeroHash) * 2
+			}
+			revErr := &revisionError{rev: rev}
+			for _, h := range candidates {
+				revErr.candidates = append(revErr.candidates, h.String()[:abbrev])
+			}
+			return nil, revErr
+		}
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, &revisionError{rev: rev, err: err}
+	}
+	return hash, nil
+}
+
+// refExists reports whether name resolves to a ref with the rules go-git uses for revisions
+func refExists(repo *git.Repository, name string) bool {
+	for _, rule := range append([]string{"%s"}, plumbing.RefRevParseRules...) {
+		if _, err := storer.ResolveReference(repo.Storer, plumbing.ReferenceName(fmt.Sprintf(rule, name))); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// commitsWithPrefix returns the commits and tags pointing at commits whose hash starts with the hex string prefix
+func commitsWithPrefix(repo *git.Repository, prefix string) []plumbing.Hash {
+	// Only whole bytes can be compared, the last digit of an odd prefix is checked on the string
+	prefixBytes, err := hex.DecodeString(prefix[:len(prefix)&^1])
+	if err != nil {
+		return nil
+	}
+
+	var hashes []plumbing.Hash
+	type prefixLister interface {
+		HashesWithPrefix(prefix []byte) ([]plumbing.Hash, error)
+	}
+	if pl, ok := repo.Storer.(prefixLister); ok {
+		// go-git only loads the pack indexes on the first object lookup and HashesWithPrefix doesn't do it,
+		// so in a freshly opened repository it would miss every packed object. The zero hash is never
+		// a loose object, looking it up always loads the indexes.
+		repo.Storer.HasEncodedObject(plumbing.ZeroHash)
+		hashes, err = pl.HashesWithPrefix(prefixBytes)
+		if err != nil {
+			return nil
+		}
+	} else {
+		iter, err := repo.Storer.IterEncodedObjects(plumbing.AnyObject)
+		if err != nil {
+			return nil
+		}
+		iter.ForEach(func(obj plumbing.EncodedObject) error {
+			h := obj.Hash()
+			if bytes.HasPrefix(h[:], prefixBytes) {
+				hashes = append(hashes, h)
+			}
+			return nil
+		})
+	}
+
+	// An object can be both loose and packed, it is only counted once
+	var commits []plumbing.Hash
+	seen := make(map[plumbing.Hash]bool)
+	for _, h := range hashes {
+		if seen[h] || !strings.HasPrefix(h.String(), prefix) {
+			continue
+		}
+		seen[h] = true
+		if _, err := repo.CommitObject(h); err == nil {
+			commits = append(commits, h)
+			continue
+		}
+		if tag, err := repo.TagObject(h); err == nil {
+			if _, err := tag.Commit(); err == nil {
+				commits = append(commits, h)
+			}
+		}
+	}
+	return commits
+}
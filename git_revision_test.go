@@ -0,0 +1,83 @@
+package gitserver
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// testRepo creates an empty repository in a temporary directory and returns it with a function that runs git in it
+func testRepo(t *testing.T) (string, func(args ...string) string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	dir := t.TempDir()
+	run := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	run("init", "-q", "-b", "main")
+	return dir, run
+}
+
+// packedRepo creates a repository with one commit and packs every object with 'git gc'
+func packedRepo(t *testing.T) (string, string) {
+	t.Helper()
+	dir, run := testRepo(t)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run("add", "a.txt")
+	run("commit", "-q", "-m", "first")
+	run("gc", "-q")
+
+	loose, _ := filepath.Glob(filepath.Join(dir, ".git", "objects", "??", "*"))
+	if len(loose) != 0 {
+		t.Fatalf("expected every object to be packed, found %d loose objects", len(loose))
+	}
+	return dir, run("rev-parse", "HEAD")
+}
+
+func TestShortHashInPackedRepository(t *testing.T) {
+	dir, head := packedRepo(t)
+
+	// Each lookup opens the repository again, nothing may have loaded the pack indexes yet
+	open := func() *git.Repository {
+		repo, err := git.PlainOpen(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repo
+	}
+
+	for _, prefix := range []string{head[:4], head[:7], head[:8]} {
+		hashes := commitsWithPrefix(open(), prefix)
+		if len(hashes) != 1 || hashes[0].String() != head {
+			t.Errorf("commitsWithPrefix(%s) = %v, want [%s]", prefix, hashes, head)
+		}
+
+		gsrv := &GitServer{}
+		hash, err := gsrv.resolveRevision(open(), prefix)
+		if err != nil {
+			t.Errorf("resolveRevision(%s): %v", prefix, err)
+		} else if hash.String() != head {
+			t.Errorf("resolveRevision(%s) = %s, want %s", prefix, hash, head)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package gitserver
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// URL path segment robots.txt is served under
+const robotsPathSegment = "robots.txt"
+
+// Browser pages of each repository that crawlers are kept out of by default, they are expensive to render
+var robotsDisallowedPages = []string{"log", "blame", "commit", "compare"}
+
+// robotsPath returns the URL path of robots.txt
+func (gsrv *GitServer) robotsPath() string {
+	prefix := strings.Trim(gsrv.IgnorePrefix, "/")
+	if prefix == "" {
+		return "/" + robotsPathSegment
+	}
+	return "/" + prefix + "/" + robotsPathSegment
+}
+
+// serveRobots writes a robots.txt for the browser. By default crawlers are kept out of the log, blame,
+// commit, and compare pages of every repository. 'allow' lets them crawl everything, and 'disallow'
+// keeps them out of the whole browser with a 'Disallow' of the prefix.
+func (gsrv *GitServer) serveRobots(w http.ResponseWriter, r *http.Request) error {
+	root, err := gsrv.requestRoot(r)
+	if err != nil {
+		return err
+	}
+	gsrv.refreshRepositories(root)
+
+	var out bytes.Buffer
+	out.WriteString("User-agent: *\n")
+	switch gsrv.Robots {
+	case "allow":
+		out.WriteString("Allow: /\n")
+	case "disallow":
+		fmt.Fprintf(&out, "Disallow: /%s\n", strings.TrimPrefix(strings.Trim(gsrv.IgnorePrefix, "/")+"/", "/"))
+	default:
+		// Each page is listed per repository, a wildcard could also match a repository named like a page
+		prefix := strings.Trim(gsrv.IgnorePrefix, "/")
+		for _, name := range gsrv.repositoryNames() {
+			repoPath := "/" + strings.TrimPrefix(prefix+"/"+name, "/")
+			for _, page := range robotsDisallowedPages {
+				fmt.Fprintf(&out, "Disallow: %s/%s\n", repoPath, page)
+			}
+		}
+		out.WriteString("Allow: /\n")
+	}
+
+	if gsrv.Sitemap {
+		fmt.Fprintf(&out, "\nSitemap: %s%s\n", gsrv.publicBaseURL(r), gsrv.sitemapPath())
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err = w.Write(out.Bytes())
+	return err
+}
@@ -0,0 +1,100 @@
+package gitserver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// rootScan holds the result of the last scan of one of the Roots
+type rootScan struct {
+	repositories []string
+	lastModified time.Time
+	// Error from the last attempt to scan the root, nil if it succeeded
+	err error
+}
+
+// updateExtraRepositories scans each of the Roots that was modified since its last scan, or all of them for a full update
+func (gsrv *GitServer) updateExtraRepositories(full bool) {
+	for i, root := range gsrv.Roots {
+		rootDir, err := os.Stat(root)
+		if err != nil {
+			gsrv.logger.Error("could not stat repository root",
+				zap.String("root", root),
+				zap.Error(err),
+			)
+			// Scan again as soon as the root is back
+			gsrv.repositoriesMu.Lock()
+			gsrv.extraScans[i].err = err
+			gsrv.extraScans[i].lastModified = time.Time{}
+			gsrv.repositoriesMu.Unlock()
+			continue
+		}
+
+		modTime := rootDir.ModTime()
+		gsrv.repositoriesMu.RLock()
+		lastModified := gsrv.extraScans[i].lastModified
+		gsrv.repositoriesMu.RUnlock()
+		if !full && !modTime.After(lastModified) {
+			continue
+		}
+
+		repositories, err := gsrv.scanRoot(root)
+		gsrv.repositoriesMu.Lock()
+		gsrv.extraScans[i] = rootScan{repositories: repositories, lastModified: modTime, err: err}
+		gsrv.repositoriesMu.Unlock()
+	}
+}
+
+// extraScanList returns the last scan of each of the Roots, in the same order.
+// The repository lists are replaced, never modified, by later scans.
+func (gsrv *GitServer) extraScanList() []rootScan {
+	gsrv.repositoriesMu.RLock()
+	defer gsrv.repositoriesMu.RUnlock()
+	return append([]rootScan{}, gsrv.extraScans...)
+}
+
+// extraRootsErr returns the error the scan of one of the Roots ended with, nil if they all succeeded
+func (gsrv *GitServer) extraRootsErr() error {
+	for _, scan := range gsrv.extraScanList() {
+		if scan.err != nil {
+			return scan.err
+		}
+	}
+	return nil
+}
+
+// extraRepositoryPath returns the path of the repository named name if it was found in one of the Roots.
+// A repository in the root or an earlier root with the same name hides it.
+func (gsrv *GitServer) extraRepositoryPath(name string) (string, bool) {
+	if len(gsrv.Roots) == 0 {
+		return "", false
+	}
+	repositories, _ := gsrv.repositoryList()
+	for _, repo := range repositories {
+		if repo == name {
+			return "", false
+		}
+	}
+	for i, scan := range gsrv.extraScanList() {
+		for _, repo := range scan.repositories {
+			if repo == name {
+				return gsrv.scannedRepoPath(gsrv.Roots[i], name), true
+			}
+		}
+	}
+	return "", false
+}
+
+// extraRootOf returns the one of the Roots that the repository at repoPath is in
+func (gsrv *GitServer) extraRootOf(repoPath string) (string, bool) {
+	for _, root := range gsrv.Roots {
+		if strings.HasPrefix(repoPath, root+string(filepath.Separator)) {
+			return root, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,59 @@
+package gitserver
+
+import (
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Default time between background scans of the root
+const defaultScanInterval = 10 * time.Second
+
+// startScanner scans the root in the background every ScanInterval until Cleanup is called.
+// A root with placeholders is only known at request time, so it is still scanned by requests.
+func (gsrv *GitServer) startScanner() {
+	if strings.Contains(gsrv.Root, "{") {
+		return
+	}
+
+	// Requests are only served once the first scan is done
+	gsrv.updateRepositories(gsrv.Root, false)
+
+	gsrv.scanStop = make(chan struct{})
+	go func(stop <-chan struct{}) {
+		ticker := time.NewTicker(time.Duration(gsrv.ScanInterval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// Adding a marker to a repository doesn't modify the root, so with an export marker
+				// the background scan walks the root every time. Requests only check its mtime.
+				gsrv.updateRepositories(gsrv.Root, gsrv.ExportMarker != "")
+			case <-stop:
+				gsrv.logger.Debug("stopped repository scanner", zap.String("root", gsrv.Root))
+				return
+			}
+		}
+	}(gsrv.scanStop)
+}
+
+// stopScanner stops the background scanner, if one was started.
+// The channel is left in place so requests still being served don't start scanning.
+func (gsrv *GitServer) stopScanner() {
+	if gsrv.scanStop != nil {
+		close(gsrv.scanStop)
+	}
+}
+
+// rescanRepositories scans the roots now, even if the roots themselves weren't modified
+func (gsrv *GitServer) rescanRepositories() {
+	gsrv.updateRepositories(gsrv.Root, true)
+}
+
+// refreshRepositories scans the root during a request when there is no background scanner
+func (gsrv *GitServer) refreshRepositories(root string) {
+	if gsrv.scanStop == nil {
+		gsrv.updateRepositories(root, false)
+	}
+}
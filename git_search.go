@@ -0,0 +1,219 @@
+package gitserver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	// Maximum number of results a search will collect
+	searchMaxResults = 300
+	// Number of results shown on each page of the search
+	searchPageSize = 50
+	// Maximum number of matching lines recorded for each file in a content search
+	searchMaxLines = 10
+	// Maximum number of files, and their total size in bytes, read by a content search
+	searchMaxBlobs = 10000
+	searchMaxBytes = 64 << 20
+	// Number of bytes checked for a null byte when detecting binary files, like git
+	binaryCheckSize = 8000
+)
+
+// errSearchBudget is returned by searchBlob once a content search read searchMaxBlobs files or searchMaxBytes bytes
+var errSearchBudget = errors.New("search read too many files")
+
+// searchBudget counts what a content search has read so far
+type searchBudget struct {
+	blobs int
+	bytes int64
+}
+
+// take accounts for reading a blob of size bytes, false if that would exceed the budget
+func (b *searchBudget) take(size int64) bool {
+	if b.blobs >= searchMaxBlobs || b.bytes+size > searchMaxBytes {
+		return false
+	}
+	b.blobs++
+	b.bytes += size
+	return true
+}
+
+type GitSearchResult struct {
+	// Path of the matching entry from the root of the tree
+	Path string
+	// File mode of the entry
+	Mode string
+	// Lines matching the query, only set for content searches
+	Lines []GitSearchLine
+}
+
+type GitSearchLine struct {
+	// Line number in the file, starting at 1
+	LineNo int
+	// Line contents
+	Content string
+}
+
+// serveSearch populates the search page with tree entries whose path contains the query.
+// The ref to search is given by the 'ref' query parameter and defaults to HEAD.
+// With 'in=content' the contents of text files up to search_max_file_size are searched too.
+func (gsrv *GitServer) serveSearch(repo *git.Repository, gb *GitBrowser, r *http.Request) error {
+	query := r.URL.Query()
+	gb.SearchQuery = strings.TrimSpace(query.Get("q"))
+	gb.SearchContent = query.Get("in") == "content"
+	if gb.SearchQuery == "" {
+		return nil
+	}
+
+	refStr := query.Get("ref")
+	if refStr == "" {
+		refStr = "HEAD"
+	}
+	hash, err := gsrv.resolveRevision(repo, refStr)
+	if err != nil {
+		// An empty repository has nothing to search
+		if refStr == "HEAD" {
+			return nil
+		}
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	// Walk the whole tree collecting matching paths, case insensitively
+	needle := strings.ToLower(gb.SearchQuery)
+	var results []GitSearchResult
+	var budget searchBudget
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	// One result past the limit is looked for, to tell a search with exactly searchMaxResults results from a truncated one
+	for len(results) <= searchMaxResults {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		result := GitSearchResult{
+			Path: name,
+			Mode: entry.Mode.String(),
+		}
+		nameMatch := strings.Contains(strings.ToLower(name), needle)
+
+		// Content searches also look inside regular files
+		if gb.SearchContent && entry.Mode.IsFile() {
+			result.Lines, err = gsrv.searchBlob(repo, entry.Hash, needle, &budget)
+			if errors.Is(err, errSearchBudget) {
+				gb.SearchTruncated = true
+				break
+			}
+			if err != nil {
+				return caddyhttp.Error(http.StatusInternalServerError, err)
+			}
+		}
+
+		if nameMatch || len(result.Lines) > 0 {
+			results = append(results, result)
+		}
+	}
+
+	if len(results) > searchMaxResults {
+		results = results[:searchMaxResults]
+		gb.SearchTruncated = true
+	}
+
+	// Paginate the results with the 'page' query parameter, starting at 1
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	start := (page - 1) * searchPageSize
+	if start > len(results) {
+		start = len(results)
+	}
+	end := start + searchPageSize
+	if end < len(results) {
+		gb.NextPage = page + 1
+	} else {
+		end = len(results)
+	}
+	if page > 1 {
+		gb.PrevPage = page - 1
+	}
+	gb.PageNumber = page
+	// The last page isn't known when the search stopped early
+	if !gb.SearchTruncated {
+		gb.LastPage = 1
+		if len(results) > 0 {
+			gb.LastPage = (len(results) + searchPageSize - 1) / searchPageSize
+		}
+	}
+	gb.SearchResults = results[start:end]
+	gb.SearchTotal = len(results)
+
+	return nil
+}
+
+// searchBlob returns the lines of a blob containing the lowercase needle.
+// Binary blobs and blobs larger than search_max_file_size are skipped.
+// It returns errSearchBudget instead of reading the blob when budget has run out.
+func (gsrv *GitServer) searchBlob(repo *git.Repository, hash plumbing.Hash, needle string, budget *searchBudget) ([]GitSearchLine, error) {
+	blob, err := repo.BlobObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	if blob.Size > gsrv.SearchMaxFileSize {
+		return nil, nil
+	}
+	if !budget.take(blob.Size) {
+		return nil, errSearchBudget
+	}
+
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if isBinary(content) {
+		return nil, nil
+	}
+
+	var lines []GitSearchLine
+	for i, line := range strings.Split(string(content), "\n") {
+		if strings.Contains(strings.ToLower(line), needle) {
+			lines = append(lines, GitSearchLine{LineNo: i + 1, Content: line})
+			if len(lines) >= searchMaxLines {
+				break
+			}
+		}
+	}
+	return lines, nil
+}
+
+// isBinary reports whether content looks binary, a null byte near the start means binary
+func isBinary(content []byte) bool {
+	if len(content) > binaryCheckSize {
+		content = content[:binaryCheckSize]
+	}
+	return bytes.IndexByte(content, 0) >= 0
+}
@@ -1,12 +1,22 @@
 package gitserver
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"io/fs"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
@@ -17,6 +27,9 @@ import (
 	"go.uber.org/zap"
 )
 
+// Date layout used when no date_format is configured
+const defaultDateFormat = "2006-01-02 15:04:05 -0700 MST"
+
 func init() {
 	caddy.RegisterModule(GitServer{})
 	httpcaddyfile.RegisterHandlerDirective("git_server", parseCaddyfile)
@@ -29,17 +42,104 @@ type GitServer struct {
 
 	// Path to directory containing bare git repos (<repo>.git)
 	Root string `json:"root,omitempty"`
+	// More directories containing repositories, e.g. on other mounts. They are searched after the Root and in order,
+	// a repository hides repositories with the same name in later roots. Placeholders aren't supported.
+	Roots []string `json:"roots,omitempty"`
 
 	// Enable repo browser
-	Browse      bool   `json:"browse,omitempty"`
-	TemplateDir string `json:"template_dir,omitempty"`
+	Browse bool `json:"browse,omitempty"`
+
+	// Url that requests for the root of the server are redirected to when Browse is off, e.g. the main site
+	BrowseIndexRedirect string `json:"browse_index_redirect,omitempty"`
+
+	// Directories containing templates that override the defaults. They are searched
+	// in order and the first one containing a template wins. TemplateDir is searched first.
+	TemplateDir  string   `json:"template_dir,omitempty"`
+	TemplateDirs []string `json:"template_dirs,omitempty"`
+
+	// Parsed templates are cached until their file is modified, disable to always re-read them
+	DisableTemplateCache bool `json:"disable_template_cache,omitempty"`
+
+	// Serve the browser at /<repo><suffix> too, instead of redirecting it to /<repo>
+	DisableStripGitSuffix bool `json:"disable_strip_git_suffix,omitempty"`
 
 	// If IgnorePrefix is defined we strip it from the URL path
 	IgnorePrefix string `json:"ignore_prefix,omitempty"`
 
-	// Mirror a git repo
-	// Mirror        bool `json:"mirror,omitempty"`
-	// MirrorRemotes []string
+	// Base url that clone urls and links are built from, e.g. 'https://git.example.com'.
+	// Derived from the request when empty.
+	PublicURL string `json:"public_url,omitempty"`
+
+	// IP ranges (supports CIDR notation) of proxies whose X-Forwarded-Proto and
+	// X-Forwarded-Host headers are trusted when deriving the public url from a request
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// Extension of the directories in the root that are repositories (default '.git')
+	RepoSuffix string `json:"repo_suffix,omitempty"`
+
+	// How repositories are found in the root: 'suffix' (default) for directories with the repo suffix,
+	// or 'content' for any directory holding a HEAD file and an objects directory, with or without the suffix
+	BareDetection string `json:"bare_detection,omitempty"`
+
+	// Repositories found in the root are only served if they contain this file, like git-daemon's 'git-daemon-export-ok'
+	ExportMarker string `json:"export_marker,omitempty"`
+
+	// Maximum number of commits the log page will ever walk, 0 for no limit
+	LogLimit int `json:"log_limit,omitempty"`
+	// Number of commits shown on each page of the log (default 100)
+	LogPageSize int `json:"log_page_size,omitempty"`
+
+	// Go time layout used for every date shown by the browser (default '2006-01-02 15:04:05 -0700 MST')
+	DateFormat string `json:"date_format,omitempty"`
+
+	// Largest file in bytes that a content search will read (default 1MiB)
+	SearchMaxFileSize int64 `json:"search_max_file_size,omitempty"`
+	// Largest file in bytes that the blob page will display (default 4MiB)
+	MaxBlobSize int64 `json:"max_blob_size,omitempty"`
+
+	// Path to an armored file of public keys that commit signatures are verified against
+	SignersFile string `json:"signers_file,omitempty"`
+
+	// Git clients must present a TLS client certificate signed by a CA in this PEM file
+	ClientCA string `json:"client_ca,omitempty"`
+	// Common names of the client certificates git clients are served to, any name if empty
+	ClientCNs []string `json:"client_cns,omitempty"`
+
+	// Maximum number of clones a client IP can start within CloneRateWindow, 0 for no limit
+	CloneRateLimit  int            `json:"clone_rate_limit,omitempty"`
+	CloneRateWindow caddy.Duration `json:"clone_rate_window,omitempty"`
+	// Maximum number of git client requests served at the same time, 0 for no limit
+	MaxConcurrentClones int `json:"max_concurrent_clones,omitempty"`
+
+	// Time between scans of the root for repositories (default 10s)
+	ScanInterval caddy.Duration `json:"scan_interval,omitempty"`
+
+	// Time between repacks of the repositories with many loose objects, 0 to never repack
+	AutoMaintenance caddy.Duration `json:"auto_maintenance,omitempty"`
+
+	// Send preload hints for the static assets of the browser pages to HTTP/2 clients
+	PreloadAssets bool `json:"preload_assets,omitempty"`
+
+	// Answer git client and browser requests for repositories, the index and namespaces with a 503
+	// while repositories are being maintained. Other requests go to the next handler as usual.
+	Maintenance        bool   `json:"maintenance,omitempty"`
+	MaintenanceMessage string `json:"maintenance_message,omitempty"`
+
+	// Serve a sitemap.xml listing the pages of every repository, requires Browse
+	Sitemap bool `json:"sitemap,omitempty"`
+
+	// What the robots.txt served with Browse lets crawlers fetch: 'allow' everything, 'disallow' keeps them
+	// out of the whole browser, and by default everything but the log, blame, commit, and compare pages
+	Robots string `json:"robots,omitempty"`
+
+	// Refs that aren't advertised to clients or shown by the browser, e.g. 'refs/internal' or 'refs/heads/wip-*'
+	HideRefs []string `json:"hide_refs,omitempty"`
+
+	// Per repository settings keyed by the repository path relative to the root, without the suffix
+	Repos map[string]RepoConfig `json:"repos,omitempty"`
+
+	// Upstream repositories that are cloned into the root and kept in sync
+	Mirrors []MirrorConfig `json:"mirrors,omitempty"`
 
 	// File server module that serves static git files
 	// FileServerRaw json.RawMessage        `json:"file_server,omitempty" caddy:"namespace=http.handlers inline_key=handler"`
@@ -49,10 +149,57 @@ type GitServer struct {
 	// If set, the IgnorePrefix is stripped
 	repositories             []string
 	repositoriesLastModified time.Time
+	// Error from the last attempt to scan the root, nil if it succeeded
+	repositoriesErr error
+	// Guards the repository list above, requests read it while another request rescans the root.
+	// Held by pointer like the caches, GitServer is copied by its value receivers.
+	repositoriesMu *sync.RWMutex
+	// Repositories found in each of the Roots, in the same order. Guarded by repositoriesMu.
+	extraScans []rootScan
+	// Closed to stop the background scanner, nil if the root is scanned by requests
+	scanStop chan struct{}
+	// Closed to stop the background repacks, nil if AutoMaintenance is off
+	repackStop chan struct{}
+	// Git client requests per repository, so repositories aren't repacked while they are fetched from
+	activity *repoActivity
+	// Stops the mirror syncs, nil if there are no mirrors
+	mirrorCancel context.CancelFunc
+
+	// Blame results keyed by commit and blob hash
+	blameCache *blameCache
+	// Parsed browser templates
+	templateCache *templateCache
+	// Size and object count of each repository
+	statsCache *repoStatsCache
+	// Ahead/behind counts keyed by the compared commit hashes
+	aheadBehindCache *aheadBehindCache
+	// Armored keyring read from SignersFile
+	signers string
+	// Certificates read from ClientCA, nil if client certificates aren't verified by the handler
+	clientCAs *x509.CertPool
+	// Parsed ranges from TrustedProxies
+	trustedProxies []netip.Prefix
+	// Clone attempts per client, nil if clones aren't rate limited
+	cloneLimiter *cloneLimiter
+	// Holds a token for every git client request being served, nil if there is no limit
+	cloneSlots chan struct{}
 
 	logger *zap.Logger
 }
 
+// RepoConfig holds settings for a single repository that override what is stored on disk
+type RepoConfig struct {
+	// Path of a repository outside the root that is served under this name
+	Path string `json:"path,omitempty"`
+	// Description shown instead of the repository's description file.
+	// The first line is the tagline, the rest is the long description.
+	Description string `json:"description,omitempty"`
+	// Branch shown by the browser when HEAD is missing or does not resolve
+	Branch string `json:"branch,omitempty"`
+	// Directory of templates used for this repository's pages, searched before the global template directories
+	TemplateDir string `json:"template_dir,omitempty"`
+}
+
 // CaddyModule returns the Caddy module information.
 func (GitServer) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
@@ -82,36 +229,287 @@ func (gsrv *GitServer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		for d.NextBlock(0) {
 			switch d.Val() {
 			case "protocol":
-				if d.NextArg() {
-					if d.Val() == "dumb" || d.Val() == "smart" || d.Val() == "both" {
-						gsrv.Protocol = d.Val()
-					} else {
-						return d.ArgErr()
-					}
-				} else {
+				if !d.AllArgs(&gsrv.Protocol) {
 					return d.ArgErr()
 				}
 			case "root":
-				if !d.AllArgs(&gsrv.Root) {
+				roots := d.RemainingArgs()
+				if len(roots) == 0 {
 					return d.ArgErr()
 				}
+				gsrv.Root = roots[0]
+				gsrv.Roots = append(gsrv.Roots, roots[1:]...)
 			case "browse":
 				gsrv.Browse = true
 			case "template_dir":
-				if !d.AllArgs(&gsrv.TemplateDir) {
+				dirs := d.RemainingArgs()
+				if len(dirs) == 0 {
+					return d.ArgErr()
+				}
+				gsrv.TemplateDirs = append(gsrv.TemplateDirs, dirs...)
+			case "sitemap":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				gsrv.Sitemap = true
+			case "robots":
+				if !d.AllArgs(&gsrv.Robots) {
+					return d.ArgErr()
+				}
+			case "maintenance":
+				var toggle string
+				if !d.Args(&toggle) {
+					return d.ArgErr()
+				}
+				switch toggle {
+				case "on":
+					gsrv.Maintenance = true
+				case "off":
+					gsrv.Maintenance = false
+				default:
+					return d.Errf("maintenance must be 'on' or 'off', got '%s'", toggle)
+				}
+				if d.NextArg() {
+					gsrv.MaintenanceMessage = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "strip_git_suffix":
+				var toggle string
+				if !d.AllArgs(&toggle) {
+					return d.ArgErr()
+				}
+				switch toggle {
+				case "on":
+					gsrv.DisableStripGitSuffix = false
+				case "off":
+					gsrv.DisableStripGitSuffix = true
+				default:
+					return d.Errf("strip_git_suffix must be 'on' or 'off', got '%s'", toggle)
+				}
+			case "preload_assets":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				gsrv.PreloadAssets = true
+			case "template_cache":
+				var toggle string
+				if !d.AllArgs(&toggle) {
+					return d.ArgErr()
+				}
+				switch toggle {
+				case "on":
+					gsrv.DisableTemplateCache = false
+				case "off":
+					gsrv.DisableTemplateCache = true
+				default:
+					return d.Errf("template_cache must be 'on' or 'off', got '%s'", toggle)
+				}
+			case "mirror":
+				var mirror MirrorConfig
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				mirror.URL = d.Val()
+				if d.NextArg() {
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil || dur <= 0 {
+						return d.Errf("invalid mirror interval '%s'", d.Val())
+					}
+					mirror.Interval = caddy.Duration(dur)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				gsrv.Mirrors = append(gsrv.Mirrors, mirror)
+			case "browse_index_redirect":
+				if !d.AllArgs(&gsrv.BrowseIndexRedirect) {
 					return d.ArgErr()
 				}
-				// case "mirror":
-				// 	gsrv.Mirror = true
-				// 	if d.NextArg() {
-				// 		gsrv.MirrorRemotes = append(gsrv.MirrorRemotes, d.Val())
-				// 	} else {
-				// 		return d.ArgErr()
-				// 	}
 			case "ignore_prefix":
 				if !d.AllArgs(&gsrv.IgnorePrefix) {
 					return d.ArgErr()
 				}
+			case "public_url":
+				if !d.AllArgs(&gsrv.PublicURL) {
+					return d.ArgErr()
+				}
+			case "trusted_proxies":
+				ranges := d.RemainingArgs()
+				if len(ranges) == 0 {
+					return d.ArgErr()
+				}
+				for _, ipRange := range ranges {
+					if ipRange == "private_ranges" {
+						gsrv.TrustedProxies = append(gsrv.TrustedProxies, []string{
+							"192.168.0.0/16",
+							"172.16.0.0/12",
+							"10.0.0.0/8",
+							"127.0.0.1/8",
+							"fd00::/8",
+							"::1",
+						}...)
+						continue
+					}
+					gsrv.TrustedProxies = append(gsrv.TrustedProxies, ipRange)
+				}
+			case "repo_suffix":
+				if !d.AllArgs(&gsrv.RepoSuffix) {
+					return d.ArgErr()
+				}
+			case "hide_refs":
+				patterns := d.RemainingArgs()
+				if len(patterns) == 0 {
+					return d.ArgErr()
+				}
+				gsrv.HideRefs = append(gsrv.HideRefs, patterns...)
+			case "bare_detection":
+				if !d.AllArgs(&gsrv.BareDetection) {
+					return d.ArgErr()
+				}
+			case "export_marker":
+				if !d.AllArgs(&gsrv.ExportMarker) {
+					return d.ArgErr()
+				}
+			case "log_limit":
+				var limit string
+				if !d.AllArgs(&limit) {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(limit)
+				if err != nil || n < 0 {
+					return d.Errf("invalid log_limit '%s'", limit)
+				}
+				gsrv.LogLimit = n
+			case "log_page_size":
+				var size string
+				if !d.AllArgs(&size) {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(size)
+				if err != nil || n < 1 {
+					return d.Errf("invalid log_page_size '%s'", size)
+				}
+				gsrv.LogPageSize = n
+			case "date_format":
+				if !d.AllArgs(&gsrv.DateFormat) {
+					return d.ArgErr()
+				}
+			case "search_max_file_size":
+				var size string
+				if !d.AllArgs(&size) {
+					return d.ArgErr()
+				}
+				n, err := strconv.ParseInt(size, 10, 64)
+				if err != nil || n < 1 {
+					return d.Errf("invalid search_max_file_size '%s'", size)
+				}
+				gsrv.SearchMaxFileSize = n
+			case "max_blob_size":
+				var size string
+				if !d.AllArgs(&size) {
+					return d.ArgErr()
+				}
+				n, err := strconv.ParseInt(size, 10, 64)
+				if err != nil || n < 1 {
+					return d.Errf("invalid max_blob_size '%s'", size)
+				}
+				gsrv.MaxBlobSize = n
+			case "signers_file":
+				if !d.AllArgs(&gsrv.SignersFile) {
+					return d.ArgErr()
+				}
+			case "client_ca":
+				if !d.AllArgs(&gsrv.ClientCA) {
+					return d.ArgErr()
+				}
+			case "client_cn":
+				cns := d.RemainingArgs()
+				if len(cns) == 0 {
+					return d.ArgErr()
+				}
+				gsrv.ClientCNs = append(gsrv.ClientCNs, cns...)
+			case "clone_rate_limit":
+				var limit, window string
+				if !d.AllArgs(&limit, &window) {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(limit)
+				if err != nil || n < 1 {
+					return d.Errf("invalid clone_rate_limit '%s'", limit)
+				}
+				dur, err := caddy.ParseDuration(window)
+				if err != nil || dur <= 0 {
+					return d.Errf("invalid clone_rate_limit window '%s'", window)
+				}
+				gsrv.CloneRateLimit = n
+				gsrv.CloneRateWindow = caddy.Duration(dur)
+			case "max_concurrent_clones":
+				var max string
+				if !d.AllArgs(&max) {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(max)
+				if err != nil || n < 1 {
+					return d.Errf("invalid max_concurrent_clones '%s'", max)
+				}
+				gsrv.MaxConcurrentClones = n
+			case "auto_maintenance":
+				var interval string
+				if !d.AllArgs(&interval) {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(interval)
+				if err != nil || dur <= 0 {
+					return d.Errf("invalid auto_maintenance '%s'", interval)
+				}
+				gsrv.AutoMaintenance = caddy.Duration(dur)
+			case "scan_interval":
+				var interval string
+				if !d.AllArgs(&interval) {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(interval)
+				if err != nil || dur <= 0 {
+					return d.Errf("invalid scan_interval '%s'", interval)
+				}
+				gsrv.ScanInterval = caddy.Duration(dur)
+			case "repo":
+				var name string
+				if !d.Args(&name) {
+					return d.ArgErr()
+				}
+				name = strings.Trim(name, "/")
+				if gsrv.Repos == nil {
+					gsrv.Repos = make(map[string]RepoConfig)
+				}
+				repoConfig := gsrv.Repos[name]
+				if d.NextArg() {
+					repoConfig.Path = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "description":
+						if !d.AllArgs(&repoConfig.Description) {
+							return d.ArgErr()
+						}
+					case "branch":
+						if !d.AllArgs(&repoConfig.Branch) {
+							return d.ArgErr()
+						}
+					case "template_dir":
+						if !d.AllArgs(&repoConfig.TemplateDir) {
+							return d.ArgErr()
+						}
+					default:
+						return d.Errf("unknown repo option '%s'", d.Val())
+					}
+				}
+				gsrv.Repos[name] = repoConfig
 			}
 		}
 	}
@@ -120,16 +518,59 @@ func (gsrv *GitServer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 func (gsrv *GitServer) Provision(ctx caddy.Context) error {
 
+	gsrv.repositoriesMu = &sync.RWMutex{}
+
 	// Support both protocol by default
 	if gsrv.Protocol == "" {
 		gsrv.Protocol = "both"
 	}
 
+	// Show 100 commits per log page by default, the log is never walked further than one page
+	if gsrv.LogPageSize <= 0 {
+		gsrv.LogPageSize = 100
+	}
+
+	// Show dates like git does by default
+	if gsrv.DateFormat == "" {
+		gsrv.DateFormat = defaultDateFormat
+	}
+
+	// Only search files up to 1MiB by default
+	if gsrv.SearchMaxFileSize == 0 {
+		gsrv.SearchMaxFileSize = 1 << 20
+	}
+
+	// Only display files up to 4MiB by default
+	if gsrv.MaxBlobSize == 0 {
+		gsrv.MaxBlobSize = 4 << 20
+	}
+
+	// Repositories are '<name>.git' directories by default. The suffix can be given with or without the leading dot.
+	if gsrv.RepoSuffix == "" {
+		gsrv.RepoSuffix = ".git"
+	} else {
+		gsrv.RepoSuffix = "." + strings.TrimPrefix(gsrv.RepoSuffix, ".")
+	}
+
 	// Serve the set root by default
 	if gsrv.Root == "" {
 		gsrv.Root = "{http.vars.root}"
 	}
 
+	// Repository paths in the other roots are built from the root, so they have to be clean to compare
+	for i, root := range gsrv.Roots {
+		gsrv.Roots[i] = filepath.Clean(root)
+	}
+	gsrv.extraScans = make([]rootScan, len(gsrv.Roots))
+
+	// Paths of explicit repositories are compared to the path returned by getRepoPath
+	for name, repoConfig := range gsrv.Repos {
+		if repoConfig.Path != "" {
+			repoConfig.Path = filepath.Clean(repoConfig.Path)
+			gsrv.Repos[name] = repoConfig
+		}
+	}
+
 	// Configure and load file_server submodule
 	// if gsrv.FileServerRaw == nil {
 	// 	// Configure a default file_server if one is not configured
@@ -149,25 +590,223 @@ func (gsrv *GitServer) Provision(ctx caddy.Context) error {
 	// Setup a logger to use
 	gsrv.logger = ctx.Logger()
 
+	// Load the keyring used to verify commit signatures
+	if gsrv.SignersFile != "" {
+		signers, err := os.ReadFile(gsrv.SignersFile)
+		if err != nil {
+			return fmt.Errorf("reading signers_file: %v", err)
+		}
+		gsrv.signers = string(signers)
+	}
+
+	// Load the CAs git client certificates are verified against
+	if err := gsrv.loadClientCAs(); err != nil {
+		return err
+	}
+
+	// Parse trusted proxy ranges ahead of time
+	for _, str := range gsrv.TrustedProxies {
+		if strings.Contains(str, "/") {
+			ipNet, err := netip.ParsePrefix(str)
+			if err != nil {
+				return fmt.Errorf("parsing CIDR expression: '%s': %v", str, err)
+			}
+			gsrv.trustedProxies = append(gsrv.trustedProxies, ipNet)
+		} else {
+			ipAddr, err := netip.ParseAddr(str)
+			if err != nil {
+				return fmt.Errorf("invalid IP address: '%s': %v", str, err)
+			}
+			gsrv.trustedProxies = append(gsrv.trustedProxies, netip.PrefixFrom(ipAddr, ipAddr.BitLen()))
+		}
+	}
+
+	// Rate limit clones per client if configured, the window defaults to a minute
+	if gsrv.CloneRateLimit > 0 {
+		if gsrv.CloneRateWindow <= 0 {
+			gsrv.CloneRateWindow = caddy.Duration(time.Minute)
+		}
+		gsrv.cloneLimiter = newCloneLimiter(gsrv.CloneRateLimit, time.Duration(gsrv.CloneRateWindow))
+	}
+
+	// Bound the git client requests served at once, generating responses for large repositories is expensive
+	if gsrv.MaxConcurrentClones > 0 {
+		gsrv.cloneSlots = make(chan struct{}, gsrv.MaxConcurrentClones)
+	}
+
+	// Register metrics once, they are shared by every git_server handler
+	gitMetrics.init.Do(initGitMetrics)
+
+	// Setup caches
+	gsrv.blameCache = &blameCache{}
+	gsrv.templateCache = &templateCache{}
+	gsrv.statsCache = &repoStatsCache{}
+	gsrv.aheadBehindCache = &aheadBehindCache{}
+
+	// Keep the repository list up to date without holding up requests
+	if gsrv.ScanInterval <= 0 {
+		gsrv.ScanInterval = caddy.Duration(defaultScanInterval)
+	}
+	gsrv.startScanner()
+
+	// Repack repositories in the background if configured
+	gsrv.activity = newRepoActivity()
+	gsrv.startRepacker()
+
+	// Keep the mirrors in sync with their upstreams
+	gsrv.startMirrors()
+
+	return nil
+}
+
+// Cleanup releases the resources held by the handler when the config is unloaded.
+// Caddy provisions a new handler on every reload, so nothing here is reused.
+func (gsrv *GitServer) Cleanup() error {
+	gsrv.stopScanner()
+	gsrv.stopRepacker()
+	gsrv.stopMirrors()
+
+	// Provision may have failed before the caches were created
+	if gsrv.blameCache != nil {
+		gsrv.blameCache.clear()
+	}
+	if gsrv.templateCache != nil {
+		gsrv.templateCache.clear()
+	}
+	if gsrv.statsCache != nil {
+		gsrv.statsCache.clear()
+	}
+	if gsrv.aheadBehindCache != nil {
+		gsrv.aheadBehindCache.clear()
+	}
+	if gsrv.cloneLimiter != nil {
+		gsrv.cloneLimiter.clear()
+	}
 	return nil
 }
 
 func (gsrv GitServer) Validate() error {
-	fmt.Println(gsrv)
+	if gsrv.BrowseIndexRedirect != "" {
+		if _, err := url.Parse(gsrv.BrowseIndexRedirect); err != nil {
+			return fmt.Errorf("invalid browse_index_redirect: %v", err)
+		}
+	}
+
+	// The public url replaces the scheme and host of the request, so it needs both
+	if gsrv.PublicURL != "" {
+		u, err := url.Parse(gsrv.PublicURL)
+		if err != nil {
+			return fmt.Errorf("invalid public_url: %v", err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("public_url must include a scheme and host: %s", gsrv.PublicURL)
+		}
+	}
+
+	// Checked here instead of the Caddyfile parser so json configs are checked too
+	if gsrv.Protocol != "dumb" && gsrv.Protocol != "smart" && gsrv.Protocol != "both" {
+		return fmt.Errorf("protocol must be 'dumb', 'smart', or 'both', got '%s'", gsrv.Protocol)
+	}
+
+	if gsrv.Robots != "" && gsrv.Robots != "allow" && gsrv.Robots != "disallow" {
+		return fmt.Errorf("robots must be 'allow' or 'disallow', got '%s'", gsrv.Robots)
+	}
+
+	if gsrv.BareDetection != "" && gsrv.BareDetection != "suffix" && gsrv.BareDetection != "content" {
+		return fmt.Errorf("bare_detection must be 'suffix' or 'content', got '%s'", gsrv.BareDetection)
+	}
+
+	// The marker is looked up inside each repository, it can't point anywhere else
+	if gsrv.ExportMarker != "" && (strings.ContainsAny(gsrv.ExportMarker, `/\`) || gsrv.ExportMarker == "..") {
+		return fmt.Errorf("export_marker must be a file name, got '%s'", gsrv.ExportMarker)
+	}
+
+	for _, mirror := range gsrv.Mirrors {
+		if _, err := mirrorName(mirror.URL, gsrv.RepoSuffix); err != nil {
+			return fmt.Errorf("invalid mirror: %v", err)
+		}
+	}
+
+	// A root with placeholders is only known at request time, anything else should exist already
+	if !strings.Contains(gsrv.Root, "{") {
+		info, err := os.Stat(gsrv.Root)
+		if err != nil {
+			return fmt.Errorf("invalid root: %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("root is not a directory: %s", gsrv.Root)
+		}
+	}
+
+	// The other roots are scanned in the background, they can't depend on the request
+	for _, root := range gsrv.Roots {
+		if strings.Contains(root, "{") {
+			return fmt.Errorf("only the first root can contain placeholders: %s", root)
+		}
+		info, err := os.Stat(root)
+		if err != nil {
+			return fmt.Errorf("invalid root: %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("root is not a directory: %s", root)
+		}
+	}
 	return nil
 }
 
 // ServeHTTP implements http.MiddlewareHandler
 func (gsrv *GitServer) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 
+	// Health check for orchestration probes
+	if r.URL.Path == gsrv.healthPath() {
+		return gsrv.serveHealth(w, r)
+	}
+
+	// Static assets used by the browser templates
+	if gsrv.Browse && gsrv.isStaticPath(r.URL.Path) {
+		return gsrv.serveStatic(w, r)
+	}
+
+	// Sitemap of the browser pages for search engines
+	if gsrv.Browse && gsrv.Sitemap && r.URL.Path == gsrv.sitemapPath() {
+		if err := gsrv.authorizeClientCert(r); err != nil {
+			return err
+		}
+		return gsrv.serveSitemap(w, r)
+	}
+
+	// Crawlers are kept away from the expensive browser pages
+	if gsrv.Browse && r.URL.Path == gsrv.robotsPath() {
+		if err := gsrv.authorizeClientCert(r); err != nil {
+			return err
+		}
+		return gsrv.serveRobots(w, r)
+	}
+
+	// A root whose placeholders don't resolve would otherwise be looked up relative to the working directory
+	if _, err := gsrv.requestRoot(r); err != nil {
+		return err
+	}
+
 	// Get repo path on disk
 	repoPath, err := gsrv.getRepoPath(r)
 	if err == nil {
 		// fmt.Println("found repo", repoPath)
 
+		// Without an allowed client certificate nothing is served from the repository. This covers the
+		// browser as well as git clients, isGitClient only looks at headers the client sets itself.
+		if err := gsrv.authorizeClientCert(r); err != nil {
+			return err
+		}
+
+		// Nothing is read from a repository during maintenance
+		if gsrv.Maintenance && (gsrv.Browse || isGitClient(r)) {
+			return gsrv.serveMaintenance(w, r)
+		}
+
 		// Here we try to detect git clients and forward them on to a special git protocol handler.
 		// All requests that enter the git client handler will return a response.
-		if r.Header.Get("Git-Protocol") != "" || strings.HasPrefix(r.UserAgent(), "git") {
+		if isGitClient(r) {
 			gsrv.logger.Debug("handling git client",
 				zap.String("git_protocol", r.Header.Get("Git-Protocol")),
 				zap.String("git_client", r.UserAgent()),
@@ -175,15 +814,39 @@ func (gsrv *GitServer) ServeHTTP(w http.ResponseWriter, r *http.Request, next ca
 				zap.String("repo_path", repoPath),
 			)
 
-			return gsrv.serveGitClient(repoPath, w, r, next)
+			mw := newMetricsWriter(w)
+			start := time.Now()
+			err := gsrv.serveGitClient(repoPath, mw, r, next)
+			emitMetrics(gsrv.repoName(repoPath, r), "git", start, mw.written)
+
+			// Every file a client fetches is its own request, the sizes add up to the size of the clone
+			gsrv.logger.Info("git request completed",
+				zap.String("req_path", r.URL.Path),
+				zap.String("git_repo", repoPath),
+				zap.String("client_ip", gsrv.clientIP(r)),
+				zap.Int("status", mw.statusCode(err)),
+				zap.Int64("bytes_written", mw.written),
+				zap.Duration("duration", time.Since(start)),
+			)
+			return err
 		}
 
 		// If browse is enabled we check if the requested repo exists and pawn it off to a browser handler.
 		if gsrv.Browse {
-			// Redirect /<repo>.git to /<repo>
-			requestPath := strings.TrimSuffix(r.URL.Path, "/")
-			if strings.HasSuffix(requestPath, ".git") {
-				http.Redirect(w, r, strings.TrimSuffix(requestPath, ".git"), http.StatusPermanentRedirect)
+			// Redirect /<repo><suffix> and /<repo>/ to the canonical /<repo>, so relative links in pages resolve the same way.
+			// With strip_git_suffix off the suffix is kept and only the trailing slash is removed.
+			requestPath := strings.TrimRight(r.URL.Path, "/")
+			_, pageName, _ := gsrv.parseBrowserPath(repoPath, r)
+			stripSuffix := !gsrv.DisableStripGitSuffix && strings.HasSuffix(requestPath, gsrv.RepoSuffix)
+			if stripSuffix || (pageName == "home" && requestPath != r.URL.Path) {
+				target := requestPath
+				if stripSuffix {
+					target = strings.TrimSuffix(requestPath, gsrv.RepoSuffix)
+				}
+				if r.URL.RawQuery != "" {
+					target += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, target, http.StatusPermanentRedirect)
 				return nil
 			}
 
@@ -191,7 +854,54 @@ func (gsrv *GitServer) ServeHTTP(w http.ResponseWriter, r *http.Request, next ca
 			gsrv.logger.Debug("handling web browser",
 				zap.String("repo_path", repoPath),
 				zap.String("req_path", r.URL.Path))
-			return gsrv.serveGitBrowser(repoPath, w, r, next)
+			mw := newMetricsWriter(w)
+			start := time.Now()
+			err := gsrv.serveGitBrowser(repoPath, mw, r, next)
+			if err != nil {
+				err = gsrv.serveErrorPage(repoPath, mw, r, err)
+			}
+			repoName, pageName, _ := gsrv.parseBrowserPath(repoPath, r)
+			emitMetrics(repoName, pageName, start, mw.written)
+			return err
+		}
+	}
+
+	// Git clients asking for a repository that doesn't exist get a clean not found error
+	if isGitClient(r) {
+		gsrv.logger.Debug("git client requested missing repository",
+			zap.String("git_client", r.UserAgent()),
+			zap.String("req_path", r.RequestURI),
+		)
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+
+	// The root of the server lists every repository when browse is enabled
+	if gsrv.Browse && gsrv.isIndexPath(r.URL.Path) {
+		if err := gsrv.authorizeClientCert(r); err != nil {
+			return err
+		}
+		if gsrv.Maintenance {
+			return gsrv.serveMaintenance(w, r)
+		}
+		return gsrv.serveRepoIndex("", w, r)
+	}
+
+	// Without the browser, visitors of the root can be sent somewhere more useful than the next handler
+	if !gsrv.Browse && gsrv.BrowseIndexRedirect != "" && gsrv.isIndexPath(r.URL.Path) {
+		http.Redirect(w, r, gsrv.BrowseIndexRedirect, http.StatusFound)
+		return nil
+	}
+
+	// Directories of repositories get an index of their own
+	if gsrv.Browse {
+		if namespace := gsrv.namespacePath(r.URL.Path); namespace != "" {
+			if err := gsrv.authorizeClientCert(r); err != nil {
+				return err
+			}
+			if gsrv.Maintenance {
+				return gsrv.serveMaintenance(w, r)
+			}
+			return gsrv.serveRepoIndex(namespace, w, r)
 		}
 	}
 
@@ -208,62 +918,396 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 
 func (gsrv *GitServer) getRepoPath(r *http.Request) (string, error) {
 	// Update repository list
-	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
-	root := repl.ReplaceAll(gsrv.Root, ".")
-	gsrv.updateRepositories(root)
+	root, err := gsrv.requestRoot(r)
+	if err != nil {
+		return "", err
+	}
+	gsrv.refreshRepositories(root)
+
+	// Check if request path begins with a repo path. The longest matching repo wins,
+	// so nested repos like 'foo/extra' take precedence over 'foo'.
+	// The path is cleaned first, so '..' segments can't pick a different repository than the one served.
+	requestPath := strings.TrimPrefix(path.Clean("/"+gsrv.stripIgnorePrefix(r.URL.Path)), "/")
+
+	// Repositories registered with an explicit path are checked before the scanned ones
+	var match string
+	for name, repoConfig := range gsrv.Repos {
+		if repoConfig.Path != "" && len(name) > len(match) && matchRepoPath(requestPath, name, gsrv.RepoSuffix) {
+			match = name
+		}
+	}
+	if match != "" {
+		return gsrv.Repos[match].Path, nil
+	}
 
-	// Check if request path begins with a repo path
-	for _, path := range gsrv.repositories {
-		if strings.HasPrefix(strings.TrimPrefix(r.URL.Path, "/"), path) {
-			return filepath.Join(root, path) + ".git", nil
+	repositories, _ := gsrv.repositoryList()
+	for _, name := range repositories {
+		if len(name) > len(match) && matchRepoPath(requestPath, name, gsrv.RepoSuffix) {
+			match = name
 		}
 	}
 
+	// Then the other roots, a repository with the same name as one matched before is hidden
+	matchRoot := root
+	for i, scan := range gsrv.extraScanList() {
+		for _, name := range scan.repositories {
+			if len(name) > len(match) && matchRepoPath(requestPath, name, gsrv.RepoSuffix) {
+				match = name
+				matchRoot = gsrv.Roots[i]
+			}
+		}
+	}
+
+	if match != "" {
+		repoPath := gsrv.scannedRepoPath(matchRoot, match)
+		if rel, err := filepath.Rel(matchRoot, repoPath); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("repo outside of root: %s", match)
+		}
+		return repoPath, nil
+	}
+
 	return "", fmt.Errorf("repo not found")
 }
 
-func (gsrv *GitServer) updateRepositories(root string) {
+// repoName returns the path of the repository at repoPath relative to the root, without the suffix.
+// Repositories registered with an explicit path use the name they were registered with.
+func (gsrv *GitServer) repoName(repoPath string, r *http.Request) string {
+	if name, ok := gsrv.explicitRepoName(repoPath); ok {
+		return name
+	}
+	root, _ := gsrv.requestRoot(r)
+	if extraRoot, ok := gsrv.extraRootOf(repoPath); ok {
+		root = extraRoot
+	}
+	return strings.TrimPrefix(strings.TrimSuffix(strings.TrimPrefix(repoPath, root), gsrv.RepoSuffix), "/")
+}
+
+// requestRoot returns the root with its placeholders replaced for the request.
+// A placeholder that is unknown or empty is an error, rather than silently serving
+// the repositories of whatever directory the root then points to.
+func (gsrv *GitServer) requestRoot(r *http.Request) (string, error) {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	root, err := repl.ReplaceOrErr(gsrv.Root, true, true)
+	if err == nil && root == "" {
+		err = fmt.Errorf("root is empty")
+	}
+	if err != nil {
+		gsrv.logger.Error("could not resolve root",
+			zap.String("root", gsrv.Root),
+			zap.Error(err),
+		)
+		return "", caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	return root, nil
+}
+
+// explicitRepoName returns the name of the repository registered with an explicit path at repoPath
+func (gsrv *GitServer) explicitRepoName(repoPath string) (string, bool) {
+	for name, repoConfig := range gsrv.Repos {
+		if repoConfig.Path != "" && repoConfig.Path == repoPath {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// resolveRepoPath returns the path of the repository named name, either registered explicitly or inside the root
+func (gsrv *GitServer) resolveRepoPath(root string, name string) string {
+	if repoConfig, ok := gsrv.Repos[name]; ok && repoConfig.Path != "" {
+		return repoConfig.Path
+	}
+	if repoPath, ok := gsrv.extraRepositoryPath(name); ok {
+		return repoPath
+	}
+	return gsrv.scannedRepoPath(root, name)
+}
+
+// scannedRepoPath returns the path of a repository found by scanning the root.
+// With content detection the repository may be stored without the suffix.
+func (gsrv *GitServer) scannedRepoPath(root string, name string) string {
+	repoPath := filepath.Join(root, name) + gsrv.RepoSuffix
+	if gsrv.BareDetection == "content" {
+		if _, err := os.Stat(repoPath); err != nil {
+			return filepath.Join(root, name)
+		}
+	}
+	return repoPath
+}
+
+// isBareRepo reports whether dir looks like a bare repository, it has a HEAD file and an objects directory
+func isBareRepo(dir string) bool {
+	head, err := os.Stat(filepath.Join(dir, "HEAD"))
+	if err != nil || !head.Mode().IsRegular() {
+		return false
+	}
+	objects, err := os.Stat(filepath.Join(dir, "objects"))
+	return err == nil && objects.IsDir()
+}
+
+// formatDate formats t with the configured DateFormat
+func (gsrv *GitServer) formatDate(t time.Time) string {
+	return t.Format(gsrv.DateFormat)
+}
+
+// isGitClient reports whether the request was made by a git client
+// ('Git-Protocol' header is present OR a user agent starting with 'git')
+func isGitClient(r *http.Request) bool {
+	return r.Header.Get("Git-Protocol") != "" || strings.HasPrefix(r.UserAgent(), "git")
+}
+
+// publicBaseURL returns the url the server is reached at, without a trailing slash.
+// The configured PublicURL is used if set, otherwise it is derived from the request.
+// X-Forwarded-Proto and X-Forwarded-Host are only honored from trusted proxies.
+func (gsrv *GitServer) publicBaseURL(r *http.Request) string {
+	if gsrv.PublicURL != "" {
+		return strings.TrimSuffix(gsrv.PublicURL, "/")
+	}
+
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		if r.TLS == nil {
+			scheme = "http"
+		} else {
+			scheme = "https"
+		}
+	}
+	host := r.Host
+
+	if gsrv.isTrustedProxy(r) {
+		// Each proxy appends to the headers, the first value is what the client used
+		if proto := firstHeaderValue(r, "X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if fwdHost := firstHeaderValue(r, "X-Forwarded-Host"); fwdHost != "" {
+			host = fwdHost
+		}
+	}
+	return scheme + "://" + urlHost(host, scheme)
+}
+
+// urlHost formats a host from a request for use in a url. IPv6 addresses are bracketed,
+// and the port is left out when it is the default port of the scheme.
+func urlHost(host string, scheme string) string {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		// No port, but a bare IPv6 address still needs brackets
+		if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil && addr.Is6() {
+			return "[" + addr.String() + "]"
+		}
+		return host
+	}
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		if strings.Contains(hostname, ":") {
+			return "[" + hostname + "]"
+		}
+		return hostname
+	}
+	return net.JoinHostPort(hostname, port)
+}
+
+// isTrustedProxy reports whether the request came directly from one of the TrustedProxies
+func (gsrv *GitServer) isTrustedProxy(r *http.Request) bool {
+	if len(gsrv.trustedProxies) == 0 {
+		return false
+	}
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	return gsrv.isTrustedAddr(clientIP)
+}
+
+// isTrustedAddr reports whether the IP address is in one of the TrustedProxies
+func (gsrv *GitServer) isTrustedAddr(ip string) bool {
+	// Client IP may contain a zone if IPv6, so we need
+	// to pull that out before parsing the IP
+	if before, _, found := strings.Cut(ip, "%"); found {
+		ip = before
+	}
+	ipAddr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, ipRange := range gsrv.trustedProxies {
+		if ipRange.Contains(ipAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstHeaderValue returns the first value of a comma separated header
+func firstHeaderValue(r *http.Request, name string) string {
+	value, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(value)
+}
+
+// stripIgnorePrefix removes the configured IgnorePrefix from the start of a URL path
+func (gsrv *GitServer) stripIgnorePrefix(urlPath string) string {
+	if gsrv.IgnorePrefix == "" {
+		return urlPath
+	}
+	prefix := "/" + strings.Trim(gsrv.IgnorePrefix, "/")
+	if urlPath == prefix {
+		return "/"
+	}
+	if strings.HasPrefix(urlPath, prefix+"/") {
+		return strings.TrimPrefix(urlPath, prefix)
+	}
+	return urlPath
+}
+
+// isIndexPath reports whether urlPath is the root of the server, after the IgnorePrefix
+func (gsrv *GitServer) isIndexPath(urlPath string) bool {
+	prefix := strings.Trim(gsrv.IgnorePrefix, "/")
+	return strings.Trim(urlPath, "/") == prefix
+}
+
+// matchRepoPath reports whether requestPath refers to the repository at repo.
+// The repo name must be followed by a path segment boundary: '/', the repo suffix, or the end of the path.
+func matchRepoPath(requestPath string, repo string, suffix string) bool {
+	if !strings.HasPrefix(requestPath, repo) {
+		return false
+	}
+	rest := requestPath[len(repo):]
+	rest = strings.TrimPrefix(rest, suffix)
+	return rest == "" || strings.HasPrefix(rest, "/")
+}
+
+// updateRepositories scans the root and the other Roots for repositories, if they were modified since the last scan.
+// A full update scans them even if they weren't, e.g. to find export markers added to existing repositories.
+func (gsrv *GitServer) updateRepositories(root string, full bool) {
+	gsrv.updateRootRepositories(root, full)
+	gsrv.updateExtraRepositories(full)
+}
+
+func (gsrv *GitServer) updateRootRepositories(root string, full bool) {
 
 	rootDir, err := os.Stat(root)
 	if err != nil {
-		fmt.Println("What? - updateRepositories()", err)
+		gsrv.logger.Error("could not stat repository root",
+			zap.String("root", root),
+			zap.Error(err),
+		)
+		// Scan again as soon as the root is back
+		gsrv.repositoriesMu.Lock()
+		gsrv.repositoriesErr = err
+		gsrv.repositoriesLastModified = time.Time{}
+		gsrv.repositoriesMu.Unlock()
 		return
 	}
 
 	// If the root has been modified since last time, update the repository list
 	modTime := rootDir.ModTime()
-	if modTime.After(gsrv.repositoriesLastModified) {
-		var newRepos []string
-		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
-				fmt.Println("walk error", err)
+	gsrv.repositoriesMu.RLock()
+	lastModified := gsrv.repositoriesLastModified
+	gsrv.repositoriesMu.RUnlock()
+	if full || modTime.After(lastModified) {
+		newRepos, err := gsrv.scanRoot(root)
+
+		// Update git server, the scan itself runs without the lock so requests aren't held up by it
+		gsrv.repositoriesMu.Lock()
+		gsrv.repositories = newRepos
+		gsrv.repositoriesLastModified = modTime
+		gsrv.repositoriesErr = err
+		gsrv.repositoriesMu.Unlock()
+	}
+}
+
+// repositoryList returns the repositories found by the last scan of the root and the error it ended with.
+// The returned slice is replaced, never modified, by later scans.
+func (gsrv *GitServer) repositoryList() ([]string, error) {
+	gsrv.repositoriesMu.RLock()
+	defer gsrv.repositoriesMu.RUnlock()
+	return gsrv.repositories, gsrv.repositoriesErr
+}
+
+// scanRoot walks root and returns the names of the repositories in it, relative to root and without the suffix
+func (gsrv *GitServer) scanRoot(root string) ([]string, error) {
+	var newRepos []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// An unreadable root means there is nothing to scan
+			if path == root {
+				gsrv.logger.Error("error scanning for repositories",
+					zap.String("path", path),
+					zap.Error(err),
+				)
 				return err
 			}
 
-			// Right now we determine a git repo by a directory with the '.git' suffix
-			if d.IsDir() && filepath.Ext(path) == ".git" {
-				// fmt.Println("Found repo", path)
-				// Strip root from path
-				path = strings.TrimPrefix(path, root)
-				// Strip '/' prefix from path
-				path = strings.TrimPrefix(path, "/")
-				// Strip .git suffix
-				path = strings.TrimSuffix(path, ".git")
-				newRepos = append(newRepos, path)
+			// Skip unreadable entries so one bad directory doesn't hide the rest
+			gsrv.logger.Warn("skipping unreadable path while scanning for repositories",
+				zap.String("path", path),
+				zap.Error(err),
+			)
+			if d != nil && d.IsDir() {
 				return fs.SkipDir
 			}
 			return nil
-		})
+		}
 
-		// Update git server
-		gsrv.repositories = newRepos
-		gsrv.repositoriesLastModified = modTime
+		// A git repo is a directory with the repo suffix, or with content detection any directory that looks like a bare repo.
+		// The root itself and the .git directory of a work tree are never listed.
+		isRepo := filepath.Ext(path) == gsrv.RepoSuffix
+		if gsrv.BareDetection == "content" {
+			isRepo = path != root && d.Name() != ".git" && isBareRepo(path)
+		}
+		if d.IsDir() && isRepo {
+			// Repositories that weren't exported are skipped entirely, including repositories nested in them
+			if gsrv.ExportMarker != "" {
+				if _, err := os.Stat(filepath.Join(path, gsrv.ExportMarker)); err != nil {
+					return fs.SkipDir
+				}
+			}
+			// fmt.Println("Found repo", path)
+			// Strip root from path
+			path = strings.TrimPrefix(path, root)
+			// Strip '/' prefix from path
+			path = strings.TrimPrefix(path, "/")
+			// Strip repo suffix
+			path = strings.TrimSuffix(path, gsrv.RepoSuffix)
+			newRepos = append(newRepos, path)
+			return fs.SkipDir
+		}
+		return nil
+	})
+	return newRepos, err
+}
+
+// compressResponse wraps w in a gzip writer if the client accepts gzip encoding.
+// The returned function must be called once the response body has been written.
+func compressResponse(w http.ResponseWriter, r *http.Request) (io.Writer, func() error) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		return w, func() error { return nil }
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	gz := gzip.NewWriter(w)
+	return gz, gz.Close
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows a gzip response
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		// A quality of zero means the encoding is not acceptable
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
 	}
+	return false
 }
 
 // Interface Guards
 var (
 	_ caddy.Provisioner           = (*GitServer)(nil)
+	_ caddy.Validator             = (*GitServer)(nil)
+	_ caddy.CleanerUpper          = (*GitServer)(nil)
 	_ caddyhttp.MiddlewareHandler = (*GitServer)(nil)
 	_ caddyfile.Unmarshaler       = (*GitServer)(nil)
 )
@@ -0,0 +1,40 @@
+package gitserver
+
+import (
+	"sort"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+)
+
+// verifyCommit checks the signature of c against the configured signers and records
+// the result on gc. Commits stay unverified when no signers are configured.
+func (gsrv *GitServer) verifyCommit(c *object.Commit, gc *GitCommit) {
+	if gsrv.signers == "" || c.PGPSignature == "" {
+		return
+	}
+
+	entity, err := c.Verify(gsrv.signers)
+	if err != nil {
+		gsrv.logger.Debug("commit signature not verified",
+			zap.String("commit", c.Hash.String()),
+			zap.Error(err),
+		)
+		return
+	}
+	gc.Verified = true
+
+	// Prefer the primary identity of the key, otherwise the first one by name
+	var names []string
+	for name, id := range entity.Identities {
+		if id.SelfSignature != nil && id.SelfSignature.IsPrimaryId != nil && *id.SelfSignature.IsPrimaryId {
+			gc.SignedBy = name
+			return
+		}
+		names = append(names, name)
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		gc.SignedBy = names[0]
+	}
+}
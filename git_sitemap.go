@@ -0,0 +1,92 @@
+package gitserver
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/go-git/go-git/v5"
+	"go.uber.org/zap"
+)
+
+// URL path segment the sitemap is served under
+const sitemapPathSegment = "sitemap.xml"
+
+// Browser pages of each repository listed in the sitemap, the home page is the repository url itself
+var sitemapPages = []string{"", "log", "tree"}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// sitemapPath returns the URL path of the sitemap
+func (gsrv *GitServer) sitemapPath() string {
+	prefix := strings.Trim(gsrv.IgnorePrefix, "/")
+	if prefix == "" {
+		return "/" + sitemapPathSegment
+	}
+	return "/" + prefix + "/" + sitemapPathSegment
+}
+
+// serveSitemap writes a sitemap listing the home, log, and tree pages of every repository.
+// The last modified date of the pages is the commit date of the repository's HEAD.
+func (gsrv *GitServer) serveSitemap(w http.ResponseWriter, r *http.Request) error {
+	root, err := gsrv.requestRoot(r)
+	if err != nil {
+		return err
+	}
+	gsrv.refreshRepositories(root)
+
+	baseURL := gsrv.publicBaseURL(r)
+	prefix := strings.Trim(gsrv.IgnorePrefix, "/")
+
+	var urlSet sitemapURLSet
+	for _, name := range gsrv.repositoryNames() {
+		repoPath := gsrv.resolveRepoPath(root, name)
+		repo, err := git.PlainOpen(repoPath)
+		if err != nil {
+			gsrv.logger.Warn("could not open repository for sitemap",
+				zap.String("git_repo", repoPath),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		var lastMod string
+		head, err := gsrv.repoHead(repo, name)
+		if err == nil {
+			headCommit, err := repo.CommitObject(head.Hash())
+			if err == nil {
+				lastMod = headCommit.Committer.When.UTC().Format(time.RFC3339)
+			}
+		}
+
+		repoURL := baseURL + "/" + strings.TrimPrefix(prefix+"/"+name, "/")
+		for _, page := range sitemapPages {
+			loc := repoURL
+			if page != "" {
+				loc += "/" + page
+			}
+			urlSet.URLs = append(urlSet.URLs, sitemapURL{Loc: loc, LastMod: lastMod})
+		}
+	}
+
+	var out bytes.Buffer
+	out.WriteString(xml.Header)
+	if err := xml.NewEncoder(&out).Encode(urlSet); err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	_, err = w.Write(out.Bytes())
+	return err
+}
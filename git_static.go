@@ -0,0 +1,92 @@
+package gitserver
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// URL path segment the static assets are served under
+const staticPathSegment = "_static"
+
+// Seconds a static asset may be cached before it is revalidated
+const staticMaxAge = 3600
+
+type staticAsset struct {
+	ContentType string
+	Data        []byte
+	// Destination of a preload hint for the asset, e.g. 'image'. Empty if it isn't preloaded.
+	PreloadAs string
+}
+
+// Decoded static assets by file name
+var static_files = map[string]staticAsset{
+	"git-icon.ico": {ContentType: "image/x-icon", Data: decodeStaticAsset(static_gitIcon), PreloadAs: "image"},
+}
+
+// decodeStaticAsset decodes an embedded base64 asset
+func decodeStaticAsset(b64 string) []byte {
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		panic(fmt.Sprintf("invalid embedded static asset: %v", err))
+	}
+	return data
+}
+
+// staticPath returns the URL path static assets are served from
+func (gsrv *GitServer) staticPath() string {
+	prefix := strings.Trim(gsrv.IgnorePrefix, "/")
+	if prefix == "" {
+		return "/" + staticPathSegment
+	}
+	return "/" + prefix + "/" + staticPathSegment
+}
+
+// staticAssets returns the static asset data passed to templates
+func (gsrv *GitServer) staticAssets() StaticAssets {
+	assets := static_assets
+	assets.Path = gsrv.staticPath()
+	return assets
+}
+
+// isStaticPath reports whether urlPath refers to a static asset
+func (gsrv *GitServer) isStaticPath(urlPath string) bool {
+	return strings.HasPrefix(urlPath, gsrv.staticPath()+"/")
+}
+
+// addPreloadLinks adds Link headers asking HTTP/2 clients to fetch the static assets used by
+// every page right away, instead of after the HTML is parsed
+func (gsrv *GitServer) addPreloadLinks(w http.ResponseWriter, r *http.Request) {
+	if !gsrv.PreloadAssets || r.ProtoMajor < 2 {
+		return
+	}
+	for name, asset := range static_files {
+		if asset.PreloadAs != "" {
+			w.Header().Add("Link", fmt.Sprintf("<%s/%s>; rel=preload; as=%s", gsrv.staticPath(), name, asset.PreloadAs))
+		}
+	}
+}
+
+// serveStatic writes an embedded static asset with long lived cache headers
+func (gsrv *GitServer) serveStatic(w http.ResponseWriter, r *http.Request) error {
+	name := strings.TrimPrefix(r.URL.Path, gsrv.staticPath()+"/")
+	asset, ok := static_files[name]
+	if !ok {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("static asset not found: %s", name))
+	}
+
+	// Assets only change when the server is upgraded, but their urls stay the same, so they are only
+	// cached briefly and revalidated by their content hash after that
+	w.Header().Set("Content-Type", asset.ContentType)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(staticMaxAge))
+	w.Header().Set("ETag", fmt.Sprintf("\"%x\"", sha1.Sum(asset.Data)))
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(asset.Data))
+	return nil
+}
@@ -0,0 +1,120 @@
+package gitserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the size of a repository is cached before the objects directory is walked again
+const repoStatsTTL = 5 * time.Minute
+
+type repoStats struct {
+	// Total size in bytes of the files in the objects directory
+	size int64
+	// Loose objects plus the objects in every pack index
+	objects  int64
+	computed time.Time
+}
+
+// repoStatsCache holds the size of each repository, keyed by its path.
+// Walking the objects directory is slow for large repositories and the result rarely changes.
+type repoStatsCache struct {
+	mu      sync.Mutex
+	entries map[string]repoStats
+}
+
+func (sc *repoStatsCache) get(repoPath string) repoStats {
+	sc.mu.Lock()
+	stats, ok := sc.entries[repoPath]
+	sc.mu.Unlock()
+	if ok && time.Since(stats.computed) < repoStatsTTL {
+		return stats
+	}
+
+	stats = readRepoStats(repoPath)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.entries == nil {
+		sc.entries = make(map[string]repoStats)
+	}
+	sc.entries[repoPath] = stats
+	return stats
+}
+
+func (sc *repoStatsCache) clear() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.entries = nil
+}
+
+// readRepoStats sums the files in the objects directory of a repository and counts its objects.
+// Loose objects are counted one by one, packed objects are counted from the fanout table of the pack index.
+// Files that can't be read are skipped, the stats are only an estimate.
+func readRepoStats(repoPath string) repoStats {
+	stats := repoStats{computed: time.Now()}
+	objectsDir := filepath.Join(repoPath, "objects")
+	filepath.WalkDir(objectsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		stats.size += info.Size()
+
+		dir := filepath.Base(filepath.Dir(path))
+		if len(dir) == 2 && isHex(dir) && isHex(d.Name()) {
+			stats.objects++
+		} else if dir == "pack" && strings.HasSuffix(d.Name(), ".idx") {
+			stats.objects += packIndexCount(path)
+		}
+		return nil
+	})
+	return stats
+}
+
+// Version 2 pack indexes start with this magic number, version 1 starts directly with the fanout table
+var packIndexMagic = []byte{0xff, 't', 'O', 'c'}
+
+// packIndexCount returns the number of objects in a pack, which is the last entry of the index fanout table
+func packIndexCount(idxPath string) int64 {
+	f, err := os.Open(idxPath)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0
+	}
+	var offset int64 = 255 * 4
+	if bytes.Equal(header, packIndexMagic) {
+		offset += 8
+	}
+
+	count := make([]byte, 4)
+	if _, err := f.ReadAt(count, offset); err != nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint32(count))
+}
+
+// isHex reports whether s only contains lowercase hexadecimal characters
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return s != ""
+}
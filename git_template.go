@@ -0,0 +1,339 @@
+package gitserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Longest a page template may take to render
+	templateTimeout = 10 * time.Second
+	// Largest page a template may render
+	templateMaxSize = 8 << 20
+)
+
+var errTemplateTooLarge = errors.New("template output exceeds the size limit")
+
+// limitedBuffer collects template output. Writes fail once the limit is exceeded
+// or the context is done, which stops the template from rendering any further.
+type limitedBuffer struct {
+	ctx   context.Context
+	buf   bytes.Buffer
+	limit int
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	if err := lb.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if lb.buf.Len()+len(p) > lb.limit {
+		return 0, errTemplateTooLarge
+	}
+	return lb.buf.Write(p)
+}
+
+// executableTemplate is satisfied by both html and text templates
+type executableTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+// executeTemplate renders tmpl with data into memory, so a template that fails halfway
+// doesn't send a partial page. The request gets an error if rendering takes longer than templateTimeout
+// or produces more than templateMaxSize bytes, a bad user template can't hold up the request.
+//
+// The timeout only bounds the output: text/template can't be interrupted, so the rendering goroutine is
+// only stopped by its next write. A template that loops without writing anything keeps running, and holds
+// on to its goroutine, until it finishes on its own.
+func executeTemplate(ctx context.Context, tmpl executableTemplate, data any) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, templateTimeout)
+	defer cancel()
+
+	out := &limitedBuffer{ctx: ctx, limit: templateMaxSize}
+	done := make(chan error, 1)
+	go func() {
+		done <- tmpl.Execute(out, data)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+		return out.buf.Bytes(), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Functions available to browser templates, documented in the README
+var templateFuncs = template.FuncMap{
+	"split":         strings.Split,
+	"shortHash":     shortHash,
+	"humanizeTime":  humanizeTime,
+	"pathJoin":      path.Join,
+	"trimPrefix":    strings.TrimPrefix,
+	"humanizeBytes": humanizeBytes,
+	"formatCount":   formatCount,
+	"dict":          dict,
+}
+
+// dict builds a map from alternating keys and values, so a template can pass several values to another template
+func dict(pairs ...any) (map[string]any, error) {
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("dict needs pairs of keys and values, got %d arguments", len(pairs))
+	}
+	m := make(map[string]any, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict keys must be strings, got %T", pairs[i])
+		}
+		m[key] = pairs[i+1]
+	}
+	return m, nil
+}
+
+// shortHash abbreviates a commit hash to its first 7 characters
+func shortHash(hash string) string {
+	if len(hash) <= 7 {
+		return hash
+	}
+	return hash[:7]
+}
+
+// humanizeTime describes how long ago t was, e.g. '3 days ago'. Both a time.Time and
+// a date string in the default date format are accepted, other values are returned as is.
+func humanizeTime(t any) string {
+	var when time.Time
+	switch v := t.(type) {
+	case time.Time:
+		when = v
+	case string:
+		parsed, err := time.Parse(defaultDateFormat, v)
+		if err != nil {
+			return v
+		}
+		when = parsed
+	default:
+		return fmt.Sprint(t)
+	}
+
+	d := time.Since(when)
+	if d < 0 {
+		return "in the future"
+	}
+	units := []struct {
+		name string
+		size time.Duration
+	}{
+		{"year", 365 * 24 * time.Hour},
+		{"month", 30 * 24 * time.Hour},
+		{"week", 7 * 24 * time.Hour},
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+	}
+	for _, unit := range units {
+		if n := int(d / unit.size); n > 0 {
+			if n == 1 {
+				return "1 " + unit.name + " ago"
+			}
+			return fmt.Sprintf("%d %ss ago", n, unit.name)
+		}
+	}
+	return "just now"
+}
+
+// humanizeBytes formats a size in bytes with a binary unit, e.g. '45.2 MiB'
+func humanizeBytes(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < 5 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTPE"[unit-1])
+}
+
+// formatCount formats a number with thousands separators, e.g. '1,234'
+func formatCount(n int64) string {
+	digits := strconv.FormatInt(n, 10)
+	sign := ""
+	if n < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	var out strings.Builder
+	for i, c := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			out.WriteByte(',')
+		}
+		out.WriteRune(c)
+	}
+	return sign + out.String()
+}
+
+// templateCache holds parsed browser templates. User templates are only re-parsed
+// once their file on disk is modified.
+type templateCache struct {
+	mu      sync.Mutex
+	entries map[string]templateCacheEntry
+}
+
+type templateCacheEntry struct {
+	template    *template.Template
+	baseModTime time.Time
+	pageModTime time.Time
+}
+
+func (tc *templateCache) get(key string, baseModTime time.Time, pageModTime time.Time) (*template.Template, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	entry, ok := tc.entries[key]
+	if !ok || !entry.baseModTime.Equal(baseModTime) || !entry.pageModTime.Equal(pageModTime) {
+		return nil, false
+	}
+	return entry.template, true
+}
+
+func (tc *templateCache) put(key string, entry templateCacheEntry) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.entries == nil {
+		tc.entries = make(map[string]templateCacheEntry)
+	}
+	tc.entries[key] = entry
+}
+
+func (tc *templateCache) clear() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.entries = nil
+}
+
+// loadBrowseTemplate parses the base template together with the template for a page.
+// Templates in the template_dir take precedence over the embedded defaults, and
+// pages without a template use the 404 page. The names of the base and page
+// templates that were used are returned for logging. The template directory of
+// repoName is searched first, use an empty repoName for pages outside a repository.
+func (gsrv *GitServer) loadBrowseTemplate(repoName, pageName string) (*template.Template, string, string, error) {
+	// Decide which base template to use (default embedded or user defined)
+	// User template must be named "base.html" and be in a template_dir
+	templateBaseStr := &template_base
+	templateBaseName := "default"
+	var baseModTime time.Time
+	if tbn, modTime, ok := gsrv.findUserTemplate(repoName, "base.html"); ok {
+		templateBaseName = tbn
+		baseModTime = modTime
+	}
+
+	// Decide which page template to use, user templates are named '<page>.html'
+	templatePageStr := template_pages[pageName]
+	templatePageName := "default-" + pageName
+	var pageModTime time.Time
+	if tpn, modTime, ok := gsrv.findUserTemplate(repoName, pageName+".html"); ok {
+		templatePageName = tpn
+		pageModTime = modTime
+	} else if templatePageStr == nil {
+		// If we couldn't find a page template, use the 404 page
+		templatePageStr = &template_page_404
+		templatePageName = "default-404"
+		if tpn, modTime, ok := gsrv.findUserTemplate(repoName, "404.html"); ok {
+			// Use user 404 page if one is found
+			templatePageName = tpn
+			pageModTime = modTime
+		}
+	}
+
+	// Reuse the parsed template if neither file has changed since it was parsed
+	cacheKey := templateBaseName + "\x00" + templatePageName
+	if !gsrv.DisableTemplateCache {
+		if browseTemplate, ok := gsrv.templateCache.get(cacheKey, baseModTime, pageModTime); ok {
+			return browseTemplate, templateBaseName, templatePageName, nil
+		}
+	}
+
+	// Read user templates from disk
+	if templateBaseName != "default" {
+		userBase, err := os.ReadFile(templateBaseName)
+		if err != nil {
+			return nil, "", "", err
+		}
+		user_template_base := string(userBase)
+		templateBaseStr = &user_template_base
+	}
+	if !strings.HasPrefix(templatePageName, "default-") {
+		userPage, err := os.ReadFile(templatePageName)
+		if err != nil {
+			return nil, "", "", err
+		}
+		user_template_page := string(userPage)
+		templatePageStr = &user_template_page
+	}
+
+	// Load up our base template
+	browseTemplate, err := template.New("browse").Funcs(templateFuncs).Parse(*templateBaseStr)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	// Load up our page template
+	_, err = browseTemplate.Parse(*templatePageStr)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if !gsrv.DisableTemplateCache {
+		gsrv.templateCache.put(cacheKey, templateCacheEntry{
+			template:    browseTemplate,
+			baseModTime: baseModTime,
+			pageModTime: pageModTime,
+		})
+	}
+
+	return browseTemplate, templateBaseName, templatePageName, nil
+}
+
+// templateDirs returns the user template directories in the order they are searched.
+// A repository's own template directory comes before the global ones.
+func (gsrv *GitServer) templateDirs(repoName string) []string {
+	var dirs []string
+	if repoDir := gsrv.Repos[repoName].TemplateDir; repoName != "" && repoDir != "" {
+		dirs = append(dirs, repoDir)
+	}
+	if gsrv.TemplateDir != "" {
+		dirs = append(dirs, gsrv.TemplateDir)
+	}
+	return append(dirs, gsrv.TemplateDirs...)
+}
+
+// isNotFoundTemplate reports whether the page template name returned by loadBrowseTemplate is a 404 page
+func isNotFoundTemplate(templatePageName string) bool {
+	return templatePageName == "default-404" || filepath.Base(templatePageName) == "404.html"
+}
+
+// findUserTemplate finds the named template in the first template directory of repoName containing it.
+// The path and modification time of the template file are returned.
+func (gsrv *GitServer) findUserTemplate(repoName, name string) (string, time.Time, bool) {
+	for _, dir := range gsrv.templateDirs(repoName) {
+		tn := filepath.Join(dir, name)
+		info, err := os.Stat(tn)
+		if err == nil && info.Mode().IsRegular() {
+			return tn, info.ModTime(), true
+		}
+	}
+	return "", time.Time{}, false
+}
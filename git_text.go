@@ -0,0 +1,43 @@
+package gitserver
+
+import (
+	_ "embed"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+//go:embed templates/text/home.txt
+var text_page_home string
+
+//go:embed templates/text/log.txt
+var text_page_log string
+
+//go:embed templates/text/tree.txt
+var text_page_tree string
+
+// Plain text renderings of the browser pages, for terminal clients like curl.
+// Pages without one are always rendered as html.
+var text_pages = map[string]*template.Template{
+	"home": template.Must(template.New("home").Funcs(template.FuncMap(templateFuncs)).Parse(text_page_home)),
+	"log":  template.Must(template.New("log").Funcs(template.FuncMap(templateFuncs)).Parse(text_page_log)),
+	"tree": template.Must(template.New("tree").Funcs(template.FuncMap(templateFuncs)).Parse(text_page_tree)),
+}
+
+// wantsText reports whether the client asked for plain text with '?format=txt', or
+// with an Accept header that lists text/plain but not html
+func wantsText(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "txt"
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") && !strings.Contains(accept, "text/html")
+}
+
+// textPage returns the plain text template of a page, nil if the page has none or the client wants html
+func textPage(pageName string, r *http.Request) *template.Template {
+	if !wantsText(r) {
+		return nil
+	}
+	return text_pages[pageName]
+}